@@ -0,0 +1,85 @@
+package cors
+
+import (
+	"container/list"
+	"sync"
+)
+
+// decisionKey identifies requests that are always decided alike by the same configuration.
+type decisionKey struct {
+	cfg     *Middleware // the configuration, or policy, that decided
+	phase   Phase
+	origin  string
+	method  string
+	headers string // the requested headers as sent
+}
+
+// decision is a cached denial.
+type decision struct {
+	key    decisionKey
+	reason string // the error message
+	rule   string
+}
+
+// decisionCache remembers the most recent denials, up to DecisionCacheSize, so that repeated requests from a scanner
+// skip evaluating the policy again. The least recently used denial is dropped first.
+type decisionCache struct {
+	mu    sync.Mutex
+	order *list.List // of *decision, most recently used first
+	items map[decisionKey]*list.Element
+}
+
+// Returns the cached denial of a request, if any.
+func (c *decisionCache) get(key decisionKey) (*decision, bool) {
+	if key.cfg.DecisionCacheSize <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(e)
+	return e.Value.(*decision), true
+}
+
+// Caches the denial of a request, dropping the least recently used ones over the limit.
+func (c *decisionCache) add(key decisionKey, reason string, rule string) {
+	size := key.cfg.DecisionCacheSize
+	if size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.items == nil {
+		c.order = list.New()
+		c.items = map[decisionKey]*list.Element{}
+	}
+
+	if e, ok := c.items[key]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&decision{key, reason, rule})
+	for c.order.Len() > size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*decision).key)
+	}
+}
+
+// Forgets every cached denial, e.g. because the configuration that made them was replaced.
+func (c *decisionCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order = nil
+	c.items = nil
+}
@@ -0,0 +1,267 @@
+// Command corsctl checks CORS middleware configuration files before they are rolled out.
+//
+//	corsctl validate a.yml [b.yml ...]
+//	corsctl diff --old a.yml --new b.yml
+//	corsctl show a.yml
+//	corsctl test --file a.yml --origin https://app.example.com --method PUT --headers authorization,x-foo
+//
+// validate prints every problem of each configuration, or a summary of the policy and any warnings,
+// and exits with status 1 when there are problems. "-" reads a configuration from standard input.
+// diff prints the changes between two configurations and exits with status 1 when
+// any of them may deny requests the old configuration allowed, or 2 on errors.
+// show prints a table of what the middleware enforces for each origin once the configuration is resolved.
+// test runs a request through the middleware and prints whether it is allowed and the headers of the response,
+// exiting with status 1 when it is denied.
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/skookum/vulcan-cors"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "corsctl"
+	app.Usage = "Check CORS middleware configuration files"
+	app.Commands = []cli.Command{
+		{
+			Name:   "validate",
+			Usage:  "Report every problem in configuration files",
+			Action: validate,
+		},
+		{
+			Name:   "diff",
+			Usage:  "Show the changes between two configuration files",
+			Action: diff,
+			Flags: []cli.Flag{
+				cli.StringFlag{"old", "", "configuration currently deployed", ""},
+				cli.StringFlag{"new", "", "configuration to roll out", ""},
+			},
+		},
+		{
+			Name:   "test",
+			Usage:  "Show how the middleware answers a request",
+			Action: test,
+			Flags: []cli.Flag{
+				cli.StringFlag{"file, f", "", "configuration file", ""},
+				cli.StringFlag{"origin, o", "", "Origin of the request", ""},
+				cli.StringFlag{"method, m", "GET", "method of the request, or the one a preflight asks for", ""},
+				cli.StringFlag{"headers, hd", "", "comma-separated headers the request sends", ""},
+				cli.StringFlag{"url, u", "http://localhost/", "URL of the request, for policy routes", ""},
+				cli.BoolFlag{"preflight, p", "send a preflight even when a browser would not", ""},
+			},
+		},
+		{
+			Name:   "show",
+			Usage:  "Print the effective policy of a configuration file",
+			Action: show,
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		fail(err)
+	}
+}
+
+func validate(c *cli.Context) {
+	if !c.Args().Present() {
+		fail(fmt.Errorf("no configuration files given"))
+	}
+
+	// Warnings are printed with each file rather than logged while loading it.
+	log.SetOutput(ioutil.Discard)
+
+	invalid := false
+	for _, path := range c.Args() {
+		m, err := cors.LoadConfig(path)
+		if err == nil {
+			fmt.Printf("%s: ok, %s\n", path, m.Summary())
+			for _, warning := range m.Warnings() {
+				fmt.Printf("%s: warning: %s\n", path, warning)
+			}
+			continue
+		}
+
+		invalid = true
+		if errs, ok := err.(cors.ValidationErrors); ok {
+			for _, e := range errs {
+				fmt.Printf("%s: %v\n", path, e)
+			}
+		} else {
+			fmt.Printf("%s: %v\n", path, err)
+		}
+	}
+
+	if invalid {
+		os.Exit(1)
+	}
+}
+
+func diff(c *cli.Context) {
+	if c.String("old") == "" || c.String("new") == "" {
+		fail(fmt.Errorf("both --old and --new are required"))
+	}
+
+	old, err := cors.LoadConfig(c.String("old"))
+	if err != nil {
+		fail(fmt.Errorf("%s: %v", c.String("old"), err))
+	}
+
+	new, err := cors.LoadConfig(c.String("new"))
+	if err != nil {
+		fail(fmt.Errorf("%s: %v", c.String("new"), err))
+	}
+
+	breaking := false
+	for _, change := range cors.Diff(old, new) {
+		fmt.Println(change)
+		breaking = breaking || change.Breaking
+	}
+
+	if breaking {
+		os.Exit(1)
+	}
+}
+
+func show(c *cli.Context) {
+	path := c.Args().First()
+	if path == "" {
+		fail(fmt.Errorf("no configuration file given"))
+	}
+
+	log.SetOutput(ioutil.Discard)
+	m, err := cors.LoadConfig(path)
+	if err != nil {
+		fail(fmt.Errorf("%s: %v", path, err))
+	}
+
+	fmt.Println(m.Summary())
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ORIGIN\tMETHODS\tHEADERS\tEXPOSED\tCREDENTIALS\tMAX AGE\tSCHEMES\tPRIVATE NETWORK\tENABLED")
+	for _, rule := range m.Rules() {
+		origin := rule.Origin
+		if rule.SuppressHeaders {
+			origin += " (no headers)"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%d\t%s\t%t\t%t\n", origin, join(rule.Methods), join(rule.Headers),
+			orNone(rule.ExposedHeaders), rule.Credentials, rule.MaxAge, join(rule.Schemes), rule.PrivateNetwork, rule.Enabled)
+	}
+	w.Flush()
+}
+
+func test(c *cli.Context) {
+	if c.String("file") == "" || c.String("origin") == "" {
+		fail(fmt.Errorf("both --file and --origin are required"))
+	}
+
+	log.SetOutput(ioutil.Discard)
+	m, err := cors.LoadConfig(c.String("file"))
+	if err != nil {
+		fail(fmt.Errorf("%s: %v", c.String("file"), err))
+	}
+
+	var denial *cors.Denial
+	m.OnDenied = func(r *http.Request, d cors.Denial) { denial = &d }
+	m.Logger = log.New(ioutil.Discard, "", 0)
+
+	handler, err := m.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if err != nil {
+		fail(err)
+	}
+
+	method := strings.ToUpper(c.String("method"))
+	var headers []string
+	for _, h := range strings.Split(c.String("headers"), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			headers = append(headers, h)
+		}
+	}
+
+	// Browsers only send a preflight first for methods and headers a form could not send.
+	// Content-Type is taken to have a value a form could not send, such as application/json.
+	preflight := c.Bool("preflight") || (method != "GET" && method != "HEAD" && method != "POST")
+	for _, h := range headers {
+		switch http.CanonicalHeaderKey(h) {
+		case "Accept", "Accept-Language", "Content-Language":
+		default:
+			preflight = true
+		}
+	}
+
+	r := httptest.NewRequest(method, c.String("url"), nil)
+	if preflight {
+		r = httptest.NewRequest("OPTIONS", c.String("url"), nil)
+		r.Header.Set("Access-Control-Request-Method", method)
+		if len(headers) > 0 {
+			r.Header.Set("Access-Control-Request-Headers", strings.ToLower(strings.Join(headers, ",")))
+		}
+	} else {
+		for _, h := range headers {
+			r.Header.Set(h, "value")
+		}
+	}
+	r.Header.Set("Origin", c.String("origin"))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	handler.(io.Closer).Close()
+
+	fmt.Printf("%s %s from %s\n", r.Method, r.URL, c.String("origin"))
+	if denial != nil {
+		fmt.Printf("deny: %s (%s", denial.Reason, denial.Phase)
+		if denial.Rule != "" {
+			fmt.Printf(", rule %s", denial.Rule)
+		}
+		fmt.Println(")")
+	} else {
+		fmt.Println("allow")
+	}
+
+	fmt.Printf("HTTP %d\n", w.Code)
+	names := make([]string, 0, len(w.Header()))
+	for name := range w.Header() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, value := range w.Header()[name] {
+			fmt.Printf("%s: %s\n", name, value)
+		}
+	}
+
+	if denial != nil {
+		os.Exit(1)
+	}
+}
+
+// Joins a list for a table cell, which must not be empty to keep the columns aligned.
+func join(list []string) string {
+	return orNone(strings.Join(list, ","))
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "corsctl:", err)
+	os.Exit(2)
+}
@@ -1,34 +1,137 @@
 package cors
 
+import "time"
+
 const (
 	// Response Headers
-	allowOriginHeader  string = "Access-Control-Allow-Origin"
-	allowMethodsHeader string = "Access-Control-Allow-Methods"
-	allowHeadersHeader string = "Access-Control-Allow-Headers"
-	maxAgeHeader       string = "Access-Control-Max-Age"
+	allowOriginHeader      string = "Access-Control-Allow-Origin"
+	allowMethodsHeader     string = "Access-Control-Allow-Methods"
+	allowHeadersHeader     string = "Access-Control-Allow-Headers"
+	maxAgeHeader           string = "Access-Control-Max-Age"
+	exposeHeadersHeader    string = "Access-Control-Expose-Headers"
+	allowCredentialsHeader string = "Access-Control-Allow-Credentials"
+
+	allowPrivateNetworkHeader string = "Access-Control-Allow-Private-Network"
+	deniedReasonHeader        string = "X-CORS-Denied-Reason"
+	reportHeader              string = "X-CORS-Report"
+	timingAllowOriginHeader   string = "Timing-Allow-Origin"
+
+	accessControlPrefix string = "Access-Control-"
 
 	// Request Headers
 	requestMethodHeader  string = "Access-Control-Request-Method"
 	requestHeadersHeader string = "Access-Control-Request-Headers"
 
+	requestPrivateNetworkHeader string = "Access-Control-Request-Private-Network"
+
 	// Common Headers
-	varyHeader   string = "Vary"
-	originHeader string = "Origin"
+	varyHeader          string = "Vary"
+	originHeader        string = "Origin"
+	contentLengthHeader string = "Content-Length"
+	authorizationHeader string = "Authorization"
+	contentTypeHeader   string = "Content-Type"
+	retryAfterHeader    string = "Retry-After"
 
 	// Request Methods
 	optionsMethod string = "OPTIONS"
+	getMethod     string = "GET"
+	headMethod    string = "HEAD"
 
 	// Error Messages
-	errorRoot         string = "request blocked by CORS:"
-	errorBadOrigin    string = "bad host"
-	errorBadMethod    string = "bad method"
-	errorBadHeader    string = "bad header"
-	errorConfigOrigin string = "must supply at least one origin or '*'"
-	errorConfigMethod string = "must supply at least one method or '*'"
-	errorConfigHeader string = "must supply at least one header or '*'"
-	errorFileIO       string = "file error"
+	errorRoot                    string = "request blocked by CORS:"
+	errorBadOrigin               string = "bad host"
+	errorBadMethod               string = "bad method"
+	errorBadHeader               string = "bad header"
+	errorForbiddenHeader         string = "forbidden header"
+	errorBadScheme               string = "bad scheme"
+	errorEmptyMethods            string = "origin allows no methods"
+	errorThrottled               string = "too many denied requests"
+	errorConfigOrigin            string = "must supply at least one origin or '*'"
+	errorConfigOriginURL         string = "origin must be a scheme and host with an optional port"
+	errorConfigWildcard          string = "wildcard must be the whole first label of a domain, e.g. https://*.example.com"
+	errorConfigMethod            string = "must supply at least one method or '*'"
+	errorConfigAllMethods        string = "'*' must be the only method"
+	errorConfigUnknownMethod     string = "unknown method"
+	errorConfigHeader            string = "must supply at least one header or '*'"
+	errorConfigMaxAge            string = "max age must not be negative"
+	errorConfigPattern           string = "invalid origin pattern"
+	errorConfigGroup             string = "undefined method group"
+	errorConfigScheme            string = "schemes must not be empty"
+	errorConfigHTTPSOnly         string = "origin must use https with https_only"
+	errorConfigStatus            string = "preflight status must be a 2xx status code"
+	errorConfigStealth           string = "stealth status must be a 4xx or 5xx status code"
+	errorConfigDenyStatus        string = "deny status must be 200 or a 4xx status code"
+	errorConfigEmptyMethods      string = "empty_methods must be deny or default, not"
+	errorConfigDefaultMethods    string = "must supply default methods for empty_methods: default"
+	errorConfigFormat            string = "unsupported config format"
+	errorConfigEnv               string = "undefined environment variable"
+	errorConfigDuplicate         string = "duplicate origin"
+	errorConfigPolicy            string = "undefined policy"
+	errorConfigRoute             string = "policy route must be a path prefix, optionally after a host"
+	errorConfigSuffix            string = "origin suffix must be a domain starting with a dot"
+	errorConfigSuffixPolicy      string = "must supply suffix_policy for origin suffixes"
+	errorConfigSimpleContentType string = "Content-Type is only safelisted for form and text values, list it in the origins' headers instead"
+	errorConfigHeaderName        string = "invalid header name"
+	errorConfigCredentials       string = "credentials are only granted to origins listed by scheme, host and port, not to \"*\", patterns, wildcards, host-only keys, suffixes, default_policy or etcd_policy"
+	errorConfigExposeCredentials string = "credentials cannot be combined with \"*\" in exposed headers"
+	errorConfigEtcd              string = "must supply etcd_endpoints and etcd_policy for etcd_prefix"
+	errorConfigConsul            string = "consulKey cannot be combined with corsFile"
+	errorConfigWatch             string = "reloading needs a local corsFile"
+	errorFileIO                  string = "file error"
+
+	// Limits
+	defaultMaxAge      int64         = 86400
+	maxConfigSize      int64         = 1 << 20
+	configReadTimeout  time.Duration = 10 * time.Second
+	watchSettleDelay   time.Duration = 100 * time.Millisecond
+	watchRetryDelay    time.Duration = 5 * time.Second
+	denialLogLimit     int           = 10
+	denialLogInterval  time.Duration = time.Minute
+	denialRateInterval time.Duration = time.Minute
+	maxLimitedClients  int           = 10000
 
 	// Common
-	allToken string = "*"
-	corsFile string = "corsFile"
+	allToken             string = "*"
+	httpsScheme          string = "https"
+	jsonContentType      string = "application/json"
+	trueToken            string = "true"
+	nullOrigin           string = "null"
+	groupPrefix          string = "@"
+	anyPort              string = ":*"
+	originsKey           string = "origins"
+	policiesPrefix       string = "policies."
+	suffixPolicyRule     string = "suffix_policy"
+	defaultPolicyRule    string = "default_policy"
+	etcdPolicyRule       string = "etcd_policy"
+	nullOriginRule       string = "allow_null_origin"
+	emptyMethodsDeny     string = "deny"
+	emptyMethodsDefault  string = "default"
+	corsFile             string = "corsFile"
+	stdinConfig          string = "-"
+	preflightStatus      string = "preflightStatus"
+	exposeHeaders        string = "exposeHeaders"
+	suffixFile           string = "suffixFile"
+	logFile              string = "logFile"
+	logStderr            string = "stderr"
+	logStdout            string = "stdout"
+	allowPrivateNetwork  string = "allowPrivateNetwork"
+	literalWildcard      string = "literalWildcard"
+	inlineOrigin         string = "origin"
+	inlineMethods        string = "methods"
+	inlineHeaders        string = "headers"
+	policyEnv            string = "CORS_POLICY"
+	corsCA               string = "corsCA"
+	corsInsecure         string = "corsInsecure"
+	watchFlag            string = "watch"
+	reloadOnHUP          string = "reloadOnHUP"
+	etcdIndexHeader      string = "X-Etcd-Index"
+	etcdKeyNotFound      int    = 100
+	consulKey            string = "consulKey"
+	consulAddr           string = "consulAddr"
+	consulToken          string = "consulToken"
+	consulTokenHeader    string = "X-Consul-Token"
+	consulTokenEnv       string = "CONSUL_HTTP_TOKEN"
+	consulIndexHeader    string = "X-Consul-Index"
+	consulWait           string = "5m"
+	defaultConsulAddress string = "http://127.0.0.1:8500"
 )
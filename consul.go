@@ -0,0 +1,105 @@
+package cors
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reloads the configuration from m.ConsulKey whenever it changes until the handler is closed,
+// using Consul blocking queries. When Consul cannot be reached the current configuration stays in use
+// and it is retried after watchRetryDelay, which is also how often the key is read when Consul returns no index.
+func (h *Handler) watchConsul(m *Middleware) {
+	address, token, key := m.consulAddress(), m.consulToken(), m.ConsulKey
+	source := "consul key " + key
+
+	h.background(func(done <-chan struct{}) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}}
+		var index uint64
+		var last []byte
+		for {
+			data, next, err := fetchConsul(ctx, client, address, token, key, index)
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err != nil {
+				h.applyConfig(source, configFormat(key), nil, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(watchRetryDelay):
+				}
+				continue
+			}
+
+			// Consul may reset its index, e.g. after a restore; starting over is then the documented recovery.
+			if next < index {
+				next = 0
+			}
+			index = next
+
+			if last == nil || !bytes.Equal(data, last) {
+				last = data
+				h.applyConfig(source, configFormat(key), data, nil)
+			}
+
+			// Without an index, e.g. behind a proxy that drops X-Consul-Index, queries cannot block, so poll instead.
+			if index == 0 {
+				select {
+				case <-ctx.Done():
+				case <-time.After(watchRetryDelay):
+				}
+			}
+		}
+	})
+}
+
+// Reads the raw value of a Consul KV key and the index it was read at. With a non-zero index
+// the query blocks until the key changes after it or Consul's wait time passes.
+func fetchConsul(ctx context.Context, client *http.Client, address, token, key string, index uint64) ([]byte, uint64, error) {
+	rawURL := strings.TrimSuffix(address, "/") + "/v1/kv/" + strings.TrimPrefix(key, "/") + "?raw"
+	if index > 0 {
+		rawURL += "&index=" + strconv.FormatUint(index, 10) + "&wait=" + consulWait
+	}
+
+	req, err := http.NewRequest(getMethod, rawURL, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %v", errorFileIO, err)
+	}
+
+	if token != "" {
+		req.Header.Set(consulTokenHeader, token)
+	}
+
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %v", errorFileIO, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%s: fetching consul key %s: %s", errorFileIO, key, res.Status)
+	}
+
+	data, err := readConfig(res.Body, key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	next, _ := strconv.ParseUint(res.Header.Get(consulIndexHeader), 10, 64)
+	return data, next, nil
+}
@@ -1,13 +1,28 @@
 package cors
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 
 	"gopkg.in/yaml.v2"
+	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
 	"github.com/vulcand/vulcand/plugin"
 )
@@ -27,12 +42,134 @@ func GetSpec() *plugin.MiddlewareSpec {
 
 // New checks input paramters and initializes the middleware
 func New(allowedOrigins map[string]*host) (*Middleware, error) {
-	_, err := validateConfig(allowedOrigins)
+	return newMiddleware(Middleware{AllowedOrigins: allowedOrigins})
+}
+
+// Validates a complete configuration and initializes the middleware from it
+func newMiddleware(cfg Middleware) (*Middleware, error) {
+	origins, err := splitOrigins(cfg.AllowedOrigins)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Middleware{allowedOrigins}, nil
+	for expr, pattern := range cfg.OriginPatterns {
+		key := "/" + expr + "/"
+		if origins == nil {
+			origins = map[string]*host{}
+		}
+
+		if _, ok := origins[key]; ok {
+			return nil, fmt.Errorf("%s %s", errorConfigDuplicate, key)
+		}
+
+		origins[key] = pattern.copy()
+	}
+
+	cfg.AllowedOrigins = origins
+	cfg.OriginPatterns = nil
+	cfg.DefaultPolicy = cfg.DefaultPolicy.copy()
+	cfg.SuffixPolicy = cfg.SuffixPolicy.copy()
+	cfg.EtcdPolicy = cfg.EtcdPolicy.copy()
+	cfg.AllowNullOrigin = cfg.AllowNullOrigin.copy()
+
+	if cfg.suffixes, err = loadSuffixes(cfg.OriginSuffixes, cfg.SuffixFile); err != nil {
+		return nil, err
+	}
+
+	if cfg.fileLogger, err = openLog(cfg.LogFile); err != nil {
+		return nil, err
+	}
+
+	if cfg.Policies != nil {
+		policies := make(map[string]map[string]*host, len(cfg.Policies))
+		for name, origins := range cfg.Policies {
+			if policies[name], err = splitOrigins(origins); err != nil {
+				return nil, fmt.Errorf("%s%s: %v", policiesPrefix, name, err)
+			}
+		}
+
+		cfg.Policies = policies
+	}
+
+	if err := validateConfig(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.compile(); err != nil {
+		return nil, err
+	}
+
+	cfg.warn()
+	return &cfg, nil
+}
+
+// Copies the origin configuration so that validation never modifies the caller's values.
+// Keys listing several comma-separated origins, e.g. "https://a.com, https://b.com", become one entry per origin.
+// Regular expression keys are never split.
+func splitOrigins(origins map[string]*host) (map[string]*host, error) {
+	if origins == nil {
+		return nil, nil
+	}
+
+	copied := make(map[string]*host, len(origins))
+	add := func(origin string, cfg *host) error {
+		if _, ok := copied[origin]; ok {
+			return fmt.Errorf("%s %s", errorConfigDuplicate, origin)
+		}
+
+		copied[origin] = cfg.copy()
+		return nil
+	}
+
+	for key, cfg := range origins {
+		if regexKey.MatchString(key) || !strings.Contains(key, ",") {
+			if err := add(key, cfg); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		for _, origin := range strings.Split(key, ",") {
+			origin = strings.TrimSpace(origin)
+			if origin == "" {
+				return nil, fmt.Errorf("%s: %q", errorConfigOrigin, key)
+			}
+
+			if err := add(origin, cfg); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return copied, nil
+}
+
+// Combines the configured origin suffixes with those listed in the suffix file, if any, in lower case.
+func loadSuffixes(suffixes []string, path string) ([]string, error) {
+	var combined []string
+	for _, suffix := range suffixes {
+		combined = append(combined, strings.ToLower(strings.TrimSpace(suffix)))
+	}
+
+	if path == "" {
+		return combined, nil
+	}
+
+	data, err := loadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		combined = append(combined, strings.ToLower(line))
+	}
+
+	return combined, nil
 }
 
 // FromOther Will be called by Vulcand when engine or API will read the middleware from the serialized format.
@@ -40,59 +177,949 @@ func New(allowedOrigins map[string]*host) (*Middleware, error) {
 // The first and the only parameter should be the struct itself, no pointers and other variables.
 // Function should return middleware interface and error in case if the parameters are wrong.
 func FromOther(m Middleware) (plugin.Middleware, error) {
-	return New(m.AllowedOrigins)
+	cm, err := newMiddleware(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return cm, nil
 }
 
 // FromCli constructs the middleware from the command line.
 func FromCli(c *cli.Context) (plugin.Middleware, error) {
-	var suppliedConfig map[string]*host
+	var data []byte
 
 	configFile := c.String(corsFile)
-	if configFile != "" {
-		yamlFile, err := ioutil.ReadFile(configFile)
+	reload := c.Bool(watchFlag) || c.Bool(reloadOnHUP)
+	if reload && (configFile == "" || configFile == stdinConfig || isConfigURL(configFile)) {
+		return nil, errors.New(errorConfigWatch)
+	}
+
+	key := c.String(consulKey)
+	if key != "" && configFile != "" {
+		return nil, errors.New(errorConfigConsul)
+	}
+
+	format := configFormat(configFile)
+	if key != "" {
+		consul := Middleware{ConsulKey: key, ConsulAddress: c.String(consulAddr), ConsulToken: c.String(consulToken)}
+		client := &http.Client{Timeout: configReadTimeout}
+
+		value, _, err := fetchConsul(context.Background(), client, consul.consulAddress(), consul.consulToken(), key, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		data = value
+		format = configFormat(key)
+	} else if configFile != "" {
+		tlsConfig, err := fetchTLSConfig(c.String(corsCA), c.Bool(corsInsecure))
+		if err != nil {
+			return nil, err
+		}
+
+		yamlFile, err := loadConfigSource(configFile, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		data = yamlFile
+	} else if policy, ok := os.LookupEnv(policyEnv); ok {
+		// Containers may pass the whole document in the environment instead; it is checked exactly like a file.
+		data = []byte(policy)
+	}
+
+	cfg, err := decodeConfig(data, format)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Overrides = cliOverrides(c)
+	cfg.Overrides.apply(&cfg)
+
+	if key != "" {
+		cfg.ConsulKey = key
+		cfg.ConsulAddress = c.String(consulAddr)
+		cfg.ConsulToken = c.String(consulToken)
+	}
+
+	if reload {
+		cfg.ConfigFile = configFile
+		cfg.Watch = c.Bool(watchFlag)
+		cfg.ReloadOnHUP = c.Bool(reloadOnHUP)
+	}
+
+	cm, err := newMiddleware(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return cm, nil
+}
+
+// LoadConfig reads a configuration file and builds the middleware from it, guessing the format from its extension.
+func LoadConfig(path string) (*Middleware, error) {
+	data, err := loadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseConfig(data, configFormat(path))
+}
+
+// ParseConfig builds and validates the middleware from serialized configuration.
+// Supported formats are "yaml" (the default when format is empty), "json" and "toml".
+// The data is either a map of origins or a document holding that map under `origins` next to the global settings.
+func ParseConfig(data []byte, format string) (*Middleware, error) {
+	cfg, err := decodeConfig(data, format)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMiddleware(cfg)
+}
+
+// Decodes serialized configuration and expands the environment variables in its origin keys without validating it.
+func decodeConfig(data []byte, format string) (Middleware, error) {
+	var cfg Middleware
+
+	switch format {
+	case "", "yaml", "yml", "json":
+		// JSON is a subset of YAML, so both share the YAML decoder and its field names.
+		if err := unmarshalConfig(data, &cfg); err != nil {
+			return cfg, positionErrors(data, err)
+		}
+	case "toml":
+		// TOML is converted to YAML first, so the lines of the converted document would only mislead.
+		if err := unmarshalTOML(data, &cfg); err != nil {
+			return cfg, positionErrors(nil, err)
+		}
+	default:
+		return cfg, fmt.Errorf("%s %q", errorConfigFormat, format)
+	}
+
+	origins, err := expandOrigins(cfg.AllowedOrigins)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.AllowedOrigins = origins
+	for name, policy := range cfg.Policies {
+		if cfg.Policies[name], err = expandOrigins(policy); err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// Matches "${NAME}" references to environment variables in origin keys.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Replaces environment variable references in the origin keys with their values.
+// Referencing an unset variable is an error rather than an empty string.
+func expandOrigins(origins map[string]*host) (map[string]*host, error) {
+	if origins == nil {
+		return nil, nil
+	}
+
+	expanded := make(map[string]*host, len(origins))
+	for origin, cfg := range origins {
+		var err error
+		key := envReference.ReplaceAllStringFunc(origin, func(ref string) string {
+			name := envReference.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("%s %s in %s", errorConfigEnv, name, origin)
+			}
+
+			return value
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := expanded[key]; ok {
+			return nil, fmt.Errorf("%s %s", errorConfigDuplicate, key)
+		}
+
+		expanded[key] = cfg
+	}
+
+	return expanded, nil
+}
+
+// Decodes either a configuration document or a plain map of origins, rejecting unknown keys.
+// The origins of a document are either a map or a list sharing the default methods and headers.
+func unmarshalConfig(data []byte, cfg *Middleware) error {
+	var document map[string]interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return err
+	}
+
+	origins, ok := document[originsKey]
+	if !ok {
+		return yaml.UnmarshalStrict(data, &cfg.AllowedOrigins)
+	}
+
+	list, ok := origins.([]interface{})
+	if !ok {
+		return yaml.UnmarshalStrict(data, cfg)
+	}
+
+	// A plain list of origins: decode the rest of the document in place, so that errors keep their lines,
+	// then give each origin the default methods and headers.
+	if err := withoutOriginList(yaml.UnmarshalStrict(data, cfg)); err != nil {
+		return err
+	}
+
+	cfg.AllowedOrigins = make(map[string]*host, len(list))
+	for _, item := range list {
+		origin, ok := item.(string)
+		if !ok {
+			return fmt.Errorf("%s: %v", errorConfigOrigin, item)
+		}
+
+		cfg.AllowedOrigins[origin] = &host{Methods: cfg.DefaultMethods, Headers: cfg.DefaultHeaders}
+	}
+
+	return nil
+}
+
+// Drops the error about a plain list of origins not being a map of origins from the decoding errors.
+func withoutOriginList(err error) error {
+	typeErr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return err
+	}
+
+	listErr := fmt.Sprintf("cannot unmarshal !!seq into %T", map[string]*host{})
+
+	var errs []string
+	for _, msg := range typeErr.Errors {
+		if !strings.HasSuffix(msg, listErr) {
+			errs = append(errs, msg)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return &yaml.TypeError{Errors: errs}
+}
+
+// Match the errors of the YAML decoder, to report where in the configuration they are.
+var (
+	yamlErrorLine  = regexp.MustCompile(`^line (\d+): (.*)$`)
+	yamlUnknownKey = regexp.MustCompile(`^field (\S+) not found in type `)
+	yamlBadValue   = regexp.MustCompile("^cannot unmarshal !!\\w+ `(.*)` into ")
+)
+
+// Turns the errors of the YAML decoder into validation errors naming the line and column of each offending entry,
+// e.g. `line 3, column 5: unknown key "metods"`. Positions are left out without the original data.
+func positionErrors(data []byte, err error) error {
+	typeErr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return err
+	}
+
+	lines := strings.Split(string(data), "\n")
+
+	errs := make(ValidationErrors, len(typeErr.Errors))
+	for i, msg := range typeErr.Errors {
+		line := 0
+		if sub := yamlErrorLine.FindStringSubmatch(msg); sub != nil {
+			line, _ = strconv.Atoi(sub[1])
+			msg = sub[2]
+		}
+
+		// The decoder finds the key or value at fault; look for it on its line to report the column.
+		token := ""
+		if sub := yamlUnknownKey.FindStringSubmatch(msg); sub != nil {
+			token = sub[1]
+			msg = fmt.Sprintf("unknown key %q", token)
+		} else if sub := yamlBadValue.FindStringSubmatch(msg); sub != nil {
+			token = strings.TrimSuffix(sub[1], "...")
+		}
+
+		if data == nil || line < 1 || line > len(lines) {
+			errs[i] = errors.New(msg)
+			continue
+		}
+
+		text := lines[line-1]
+		column := strings.Index(text, token) + 1
+		if token == "" || column == 0 {
+			column = len(text) - len(strings.TrimLeft(text, " \t")) + 1
+		}
+
+		errs[i] = fmt.Errorf("line %d, column %d: %s", line, column, msg)
+	}
+
+	return errs
+}
+
+func unmarshalTOML(data []byte, cfg *Middleware) error {
+	var document map[string]interface{}
+	if err := toml.Unmarshal(data, &document); err != nil {
+		return err
+	}
+
+	converted, err := yaml.Marshal(document)
+	if err != nil {
+		return err
+	}
+
+	return unmarshalConfig(converted, cfg)
+}
+
+// Reads a configuration file, giving up on files that are too large or too slow to read.
+func loadConfigFile(path string) ([]byte, error) {
+	return loadConfigSource(path, nil)
+}
+
+// Reads a configuration file, or standard input for "-", or fetches it when the path is an http or https URL.
+// tlsConfig verifies https servers and may be nil to use the system roots.
+func loadConfigSource(path string, tlsConfig *tls.Config) ([]byte, error) {
+	if isConfigURL(path) {
+		return fetchConfig(path, tlsConfig)
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		// "-" reads the policy from standard input, e.g. when a pipeline pipes a generated one in.
+		if path == stdinConfig {
+			data, err := readConfig(os.Stdin, "standard input")
+			done <- result{data, err}
+			return
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			done <- result{nil, fmt.Errorf("%s: %v", errorFileIO, err)}
+			return
+		}
+		defer f.Close()
+
+		// Reading a directory fails with an obscure error on some systems and succeeds with no data on others.
+		if fi, err := f.Stat(); err == nil && fi.IsDir() {
+			done <- result{nil, fmt.Errorf("%s: %s is a directory, not a readable file", errorFileIO, path)}
+			return
+		}
+
+		data, err := readConfig(f, path)
+		done <- result{data, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.data, res.err
+	case <-time.After(configReadTimeout):
+		return nil, fmt.Errorf("%s: reading %s timed out after %v", errorFileIO, path, configReadTimeout)
+	}
+}
+
+// Reports whether a configuration path is an http or https URL rather than a file.
+func isConfigURL(path string) bool {
+	lower := strings.ToLower(path)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, httpsScheme+"://")
+}
+
+// Fetches configuration from a config service, failing on anything but a 200 so that no partial policy is loaded.
+func fetchConfig(rawURL string, tlsConfig *tls.Config) ([]byte, error) {
+	client := &http.Client{
+		Timeout:   configReadTimeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+	}
+
+	res, err := client.Get(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", errorFileIO, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: fetching %s: %s", errorFileIO, rawURL, res.Status)
+	}
+
+	return readConfig(res.Body, rawURL)
+}
+
+// Builds the TLS configuration used to fetch configuration over https from a PEM file of trusted CAs,
+// replacing the system roots, and whether to skip verification altogether. Returns nil for the defaults.
+func fetchTLSConfig(caFile string, insecure bool) (*tls.Config, error) {
+	if caFile == "" && !insecure {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := loadConfigFile(caFile)
 		if err != nil {
-			fmt.Println(errorFileIO)
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: %s holds no PEM certificates", errorFileIO, caFile)
 		}
+	}
+
+	return tlsConfig, nil
+}
+
+// Reads at most maxConfigSize bytes of configuration, failing when there is more.
+func readConfig(r io.Reader, name string) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxConfigSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading %s: %v", errorFileIO, name, err)
+	}
+
+	if int64(len(data)) > maxConfigSize {
+		return nil, fmt.Errorf("%s: %s exceeds the %d byte limit", errorFileIO, name, maxConfigSize)
+	}
+
+	return data, nil
+}
+
+// Overrides are settings given on the command line on top of the configuration file or Consul key.
+// They are kept with the middleware and applied again whenever the configuration is reloaded.
+type Overrides struct {
+	Origins             []string // origins added with the methods and headers below, replacing file entries with the same key
+	Methods             []string // methods of Origins, DefaultMethods when empty
+	Headers             []string // headers of Origins, DefaultHeaders or the CORS-safelisted ones when empty
+	AllowPrivateNetwork bool
+	LiteralWildcard     bool
+	SuffixFile          string
+	PreflightStatus     int
+	ExposeHeaders       []string // replace DefaultExposedHeaders when not empty
+	LogFile             string
+}
+
+// Reads the overrides given as flags, or nil when there are none.
+func cliOverrides(c *cli.Context) *Overrides {
+	o := Overrides{
+		Methods:             parseHeaderList(c.String(inlineMethods)),
+		Headers:             parseHeaderList(c.String(inlineHeaders)),
+		AllowPrivateNetwork: c.Bool(allowPrivateNetwork),
+		LiteralWildcard:     c.Bool(literalWildcard),
+		SuffixFile:          c.String(suffixFile),
+		PreflightStatus:     c.Int(preflightStatus),
+		ExposeHeaders:       parseHeaderList(c.String(exposeHeaders)),
+		LogFile:             c.String(logFile),
+	}
+
+	for _, value := range c.StringSlice(inlineOrigin) {
+		o.Origins = append(o.Origins, parseHeaderList(value)...)
+	}
+
+	if o.Origins == nil && !o.AllowPrivateNetwork && !o.LiteralWildcard && o.SuffixFile == "" && o.PreflightStatus == 0 && o.ExposeHeaders == nil && o.LogFile == "" {
+		return nil
+	}
+
+	return &o
+}
+
+// Applies the overrides to a configuration decoded from the file. Does nothing when o is nil.
+func (o *Overrides) apply(cfg *Middleware) {
+	if o == nil {
+		return
+	}
+
+	if len(o.Origins) > 0 {
+		methods := o.Methods
+		if methods == nil {
+			methods = cfg.DefaultMethods
+		}
+
+		// Without any headers, origins may still request the CORS-safelisted ones.
+		headers := o.Headers
+		if headers == nil {
+			headers = cfg.DefaultHeaders
+		}
+		if headers == nil {
+			headers = defaultSimpleHeaders
+		}
+
+		if cfg.AllowedOrigins == nil {
+			cfg.AllowedOrigins = make(map[string]*host, len(o.Origins))
+		}
+
+		for _, origin := range o.Origins {
+			cfg.AllowedOrigins[origin] = &host{Methods: methods, Headers: headers}
+		}
+	}
+
+	if o.AllowPrivateNetwork {
+		cfg.AllowPrivateNetwork = true
+	}
+
+	if o.LiteralWildcard {
+		cfg.LiteralWildcard = true
+	}
+
+	if o.SuffixFile != "" {
+		cfg.SuffixFile = o.SuffixFile
+	}
+
+	if o.PreflightStatus != 0 {
+		cfg.PreflightStatus = o.PreflightStatus
+	}
+
+	if o.ExposeHeaders != nil {
+		cfg.DefaultExposedHeaders = o.ExposeHeaders
+	}
+
+	if o.LogFile != "" {
+		cfg.LogFile = o.LogFile
+	}
+}
+
+// Guesses the format of a configuration file from its extension, defaulting to YAML.
+func configFormat(path string) string {
+	if u, err := url.Parse(path); err == nil && isConfigURL(path) {
+		path = u.Path
+	}
+
+	switch ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), ".")); ext {
+	case "json", "toml":
+		return ext
+	}
+
+	return "yaml"
+}
+
+// Loggers writing to files by path. Files stay open for the life of the process, shared by every configuration
+// logging to them, so that reloading the configuration does not open them again.
+var logFiles = struct {
+	sync.Mutex
+	loggers map[string]*log.Logger
+}{loggers: map[string]*log.Logger{}}
+
+// Returns the logger writing to the given LogFile, or nil when it is empty.
+func openLog(destination string) (*log.Logger, error) {
+	switch destination {
+	case "":
+		return nil, nil
+	case logStderr:
+		return log.New(os.Stderr, "", log.LstdFlags), nil
+	case logStdout:
+		return log.New(os.Stdout, "", log.LstdFlags), nil
+	}
+
+	logFiles.Lock()
+	defer logFiles.Unlock()
 
-		yaml.Unmarshal(yamlFile, &suppliedConfig)
+	if logger := logFiles.loggers[destination]; logger != nil {
+		return logger, nil
 	}
 
-	return New(suppliedConfig)
+	file, err := os.OpenFile(destination, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", errorFileIO, err)
+	}
+
+	logger := log.New(file, "", log.LstdFlags)
+	logFiles.loggers[destination] = logger
+	return logger, nil
 }
 
 // CliFlags will be used by Vulcan construct help and CLI command for `vctl`
 func CliFlags() []cli.Flag {
 	return []cli.Flag{
-		cli.StringFlag{"corsFile, cf", "", "YAML configuration file", ""},
+		cli.StringFlag{"corsFile, cf", "", "YAML, JSON or TOML configuration file, an http(s) URL to fetch it from, or - for standard input", ""},
+		cli.StringFlag{"corsCA", "", "PEM file of the CAs trusted to serve an https corsFile", ""},
+		cli.BoolFlag{"corsInsecure", "Skip TLS verification of an https corsFile, for testing only", ""},
+		cli.StringFlag{"consulKey", "", "Consul KV key holding the configuration instead of corsFile, reloaded whenever it changes", ""},
+		cli.StringFlag{"consulAddr", "", "HTTP address of the Consul agent (default http://127.0.0.1:8500)", "CONSUL_HTTP_ADDR"},
+		cli.StringFlag{"consulToken", "", "ACL token used to read consulKey, not stored with the middleware", consulTokenEnv},
+		cli.BoolFlag{"watch, w", "Reload corsFile whenever it changes", ""},
+		cli.BoolFlag{"reloadOnHUP, hup", "Reload corsFile whenever vulcand receives SIGHUP", ""},
+		cli.StringSliceFlag{"origin, o", &cli.StringSlice{}, "Allowed origin, repeatable (always as -origin or always as -o) or comma-separated, instead of or in addition to corsFile", ""},
+		cli.StringFlag{"methods, m", "", "Comma-separated methods allowed to the -origin origins", ""},
+		cli.StringFlag{"headers, hd", "", "Comma-separated headers allowed to the -origin origins", ""},
+		cli.BoolFlag{"allowPrivateNetwork, apn", "Answer Private Network Access preflights", ""},
+		cli.BoolFlag{"literalWildcard, lw", "Answer origins allowed by * with a literal *", ""},
+		cli.StringFlag{"suffixFile, sf", "", "File listing allowed origin suffixes, one per line", ""},
+		cli.IntFlag{"preflightStatus, ps", 0, "Status code of successful preflight responses, e.g. 204 (default 200)", ""},
+		cli.StringFlag{"exposeHeaders, eh", "", "Comma-separated response headers exposed to every origin", ""},
+		cli.StringFlag{"logFile, lf", "", "Where CORS logs go: stderr (default), stdout or a file appended to", ""},
 	}
 }
 
-// Validates the configuration file.
-func validateConfig(origins map[string]*host) (bool, error) {
-	if len(origins) == 0 {
-		return false, errors.New(errorConfigOrigin)
+// ValidationErrors holds every problem found in a configuration.
+type ValidationErrors []error
+
+// Error lists the problems separated by semicolons.
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
 	}
 
-	for origin, cfg := range origins {
-		if origin == "" {
-			return false, errors.New(errorConfigOrigin)
+	return strings.Join(messages, "; ")
+}
+
+// Validate reports every problem in the configuration at once, as ValidationErrors, without modifying it.
+func (m *Middleware) Validate() error {
+	_, err := newMiddleware(*m)
+	return err
+}
+
+// Validates the configuration file, collecting every problem rather than stopping at the first one.
+func validateConfig(m *Middleware) error {
+	var errs ValidationErrors
+	if len(m.AllowedOrigins) == 0 && len(m.suffixes) == 0 && m.EtcdPrefix == "" {
+		errs = append(errs, errors.New(errorConfigOrigin))
+	}
+
+	if m.PreflightStatus != 0 && (m.PreflightStatus < 200 || m.PreflightStatus > 299) {
+		errs = append(errs, errors.New(errorConfigStatus))
+	}
+
+	if m.DefaultMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("default_max_age: %s", errorConfigMaxAge))
+	}
+
+	if m.DenyStatus != 0 && m.DenyStatus != http.StatusOK && (m.DenyStatus < 400 || m.DenyStatus > 499) {
+		errs = append(errs, errors.New(errorConfigDenyStatus))
+	}
+
+	if m.StealthStatus != 0 && (m.StealthStatus < 400 || m.StealthStatus > 599) {
+		errs = append(errs, errors.New(errorConfigStealth))
+	}
+
+	// A misspelt safelisted header would silently stop being allowed.
+	for _, h := range m.SimpleHeaders {
+		if !isToken(h) {
+			errs = append(errs, fmt.Errorf("simple_headers: %s %q", errorConfigHeaderName, h))
+		} else if http.CanonicalHeaderKey(h) == contentTypeHeader {
+			// Its safelisted values never need a preflight, so allowing it there would allow every other value.
+			errs = append(errs, fmt.Errorf("simple_headers: %s", errorConfigSimpleContentType))
+		}
+	}
+
+	switch m.EmptyMethods {
+	case "", emptyMethodsDeny:
+	case emptyMethodsDefault:
+		if len(m.DefaultMethods) == 0 {
+			errs = append(errs, errors.New(errorConfigDefaultMethods))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("%s %q", errorConfigEmptyMethods, m.EmptyMethods))
+	}
+
+	errs = append(errs, validateOrigins(m, m.AllowedOrigins, "")...)
+
+	if m.DefaultPolicy != nil {
+		for _, err := range validateHost(m, m.DefaultPolicy) {
+			errs = append(errs, fmt.Errorf("%s: %v", defaultPolicyRule, err))
+		}
+
+		for _, err := range validateCredentials(m, defaultPolicyRule, m.DefaultPolicy) {
+			errs = append(errs, fmt.Errorf("%s: %v", defaultPolicyRule, err))
+		}
+	}
+
+	if m.AllowNullOrigin != nil {
+		for _, err := range validateHost(m, m.AllowNullOrigin) {
+			errs = append(errs, fmt.Errorf("%s: %v", nullOriginRule, err))
+		}
+
+		for _, err := range validateCredentials(m, nullOriginRule, m.AllowNullOrigin) {
+			errs = append(errs, fmt.Errorf("%s: %v", nullOriginRule, err))
+		}
+	}
+
+	for _, suffix := range m.suffixes {
+		if !validSuffix(suffix) {
+			errs = append(errs, fmt.Errorf("%q: %s", suffix, errorConfigSuffix))
+		}
+	}
+
+	if len(m.suffixes) > 0 && m.SuffixPolicy == nil {
+		errs = append(errs, errors.New(errorConfigSuffixPolicy))
+	}
+
+	if m.SuffixPolicy != nil {
+		for _, err := range validateHost(m, m.SuffixPolicy) {
+			errs = append(errs, fmt.Errorf("%s: %v", suffixPolicyRule, err))
+		}
+
+		for _, err := range validateCredentials(m, suffixPolicyRule, m.SuffixPolicy) {
+			errs = append(errs, fmt.Errorf("%s: %v", suffixPolicyRule, err))
+		}
+	}
+
+	if m.EtcdPrefix != "" && (len(m.EtcdEndpoints) == 0 || m.EtcdPolicy == nil) {
+		errs = append(errs, errors.New(errorConfigEtcd))
+	}
+
+	for _, endpoint := range m.EtcdEndpoints {
+		if !isConfigURL(endpoint) {
+			errs = append(errs, fmt.Errorf("etcd_endpoints: %q: %s", endpoint, errorConfigOriginURL))
+		}
+	}
+
+	if m.EtcdPolicy != nil {
+		for _, err := range validateHost(m, m.EtcdPolicy) {
+			errs = append(errs, fmt.Errorf("%s: %v", etcdPolicyRule, err))
+		}
+
+		for _, err := range validateCredentials(m, etcdPolicyRule, m.EtcdPolicy) {
+			errs = append(errs, fmt.Errorf("%s: %v", etcdPolicyRule, err))
+		}
+	}
+
+	names := make([]string, 0, len(m.Policies))
+	for name := range m.Policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		prefix := policiesPrefix + name + " "
+		if len(m.Policies[name]) == 0 {
+			errs = append(errs, fmt.Errorf("%s%s", prefix, errorConfigOrigin))
+		}
+
+		errs = append(errs, validateOrigins(m, m.Policies[name], prefix)...)
+	}
+
+	routes := make([]string, 0, len(m.PolicyRoutes))
+	for route := range m.PolicyRoutes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	for _, route := range routes {
+		if !strings.Contains(route, "/") {
+			errs = append(errs, fmt.Errorf("%s: %s", route, errorConfigRoute))
+		}
+
+		if _, ok := m.Policies[m.PolicyRoutes[route]]; !ok {
+			errs = append(errs, fmt.Errorf("%s: %s %q", route, errorConfigPolicy, m.PolicyRoutes[route]))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+// Validates the origins in key order, prefixing each problem with the prefix and the origin key.
+func validateOrigins(m *Middleware, origins map[string]*host, prefix string) []error {
+	keys := make([]string, 0, len(origins))
+	for origin := range origins {
+		keys = append(keys, origin)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, origin := range keys {
+		cfg := origins[origin]
+		if origin == "" || cfg == nil {
+			errs = append(errs, fmt.Errorf("%s%q: %s", prefix, origin, errorConfigOrigin))
+			continue
+		}
+
+		if err := validateOriginKey(origin); err != nil {
+			errs = append(errs, fmt.Errorf("%s%s: %v", prefix, origin, err))
+		}
+
+		if scheme := keyScheme(origin); m.HTTPSOnly && scheme != "" && scheme != httpsScheme {
+			errs = append(errs, fmt.Errorf("%s%s: %s", prefix, origin, errorConfigHTTPSOnly))
+		}
+
+		for _, err := range validateHost(m, cfg) {
+			errs = append(errs, fmt.Errorf("%s%s: %v", prefix, origin, err))
+		}
+
+		for _, err := range validateCredentials(m, origin, cfg) {
+			errs = append(errs, fmt.Errorf("%s%s: %v", prefix, origin, err))
+		}
+	}
+
+	return errs
+}
+
+// Rejects credentials on rules matching origins that are not listed one by one, "*", patterns and the default policy,
+// which would let any site they match make credentialed reads, and on rules exposing "*", which browsers take
+// for a header named "*" on credentialed responses, so that no header would be exposed at all.
+func validateCredentials(m *Middleware, rule string, cfg *host) []error {
+	if !cfg.Credentials {
+		return nil
+	}
+
+	var errs []error
+	if broadRule(rule) {
+		errs = append(errs, errors.New(errorConfigCredentials))
+	}
+
+	exposed := m.exposedHeaders(rule)
+	if cfg.ExposedHeaders != nil {
+		exposed = joinHeaders(cfg.ExposedHeaders)
+	}
+
+	if stringInSlice(allToken, parseHeaderList(exposed)) {
+		errs = append(errs, errors.New(errorConfigExposeCredentials))
+	}
+
+	return errs
+}
+
+// Reports whether an origin suffix is a dot followed by a domain of at least two labels, e.g. ".example.com".
+func validSuffix(suffix string) bool {
+	labels := strings.Split(strings.TrimPrefix(suffix, "."), ".")
+	if !strings.HasPrefix(suffix, ".") || len(labels) < 2 {
+		return false
+	}
+
+	for _, label := range labels {
+		if label == "" || strings.IndexFunc(label, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-')
+		}) >= 0 {
+			return false
 		}
+	}
 
-		if len(cfg.Methods) == 0 {
-			return false, errors.New(errorConfigMethod)
+	return true
+}
+
+// Validates an allowed origin key: "*", a regular expression, a host or an origin made of a scheme, a host and maybe a port or ":*".
+// A host may start with "*." to stand for every subdomain.
+func validateOriginKey(origin string) error {
+	if origin == allToken {
+		return nil
+	}
+
+	if !regexKey.MatchString(origin) && strings.Contains(strings.TrimSuffix(origin, anyPort), allToken) {
+		if sub, ok := parseSubdomainKey(origin); !ok || !validSuffix(sub.suffix) {
+			return errors.New(errorConfigWildcard)
 		}
+	}
+
+	if isHostOnly(origin) {
+		return nil
+	}
 
-		if len(cfg.Headers) == 0 {
-			return false, errors.New(errorConfigHeader)
+	if sub := regexKey.FindStringSubmatch(origin); sub != nil {
+		if _, err := regexp.Compile(sub[1]); err != nil {
+			return fmt.Errorf("%s: %v", errorConfigPattern, err)
 		}
 
-		var canonicalHeaders []string
-		for _, h := range cfg.Headers {
-			canonicalHeaders = append(canonicalHeaders, http.CanonicalHeaderKey(h))
+		return nil
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(origin, anyPort))
+	if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return errors.New(errorConfigOriginURL)
+	}
+
+	return nil
+}
+
+// Validates a single origin configuration, expanding references to method groups.
+func validateHost(m *Middleware, cfg *host) []error {
+	var errs []error
+	if len(cfg.Methods) == 0 && m.EmptyMethods == emptyMethodsDefault {
+		cfg.Methods = m.DefaultMethods
+	}
+
+	if err := expandMethods(cfg, m.MethodGroups); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(cfg.Methods) == 0 && m.EmptyMethods != emptyMethodsDeny {
+		errs = append(errs, errors.New(errorConfigMethod))
+	}
+
+	if len(cfg.Methods) > 1 && stringInSlice(allToken, cfg.Methods) {
+		errs = append(errs, errors.New(errorConfigAllMethods))
+	}
+
+	for _, method := range cfg.Methods {
+		if method != allToken && !m.isKnownMethod(method) {
+			errs = append(errs, fmt.Errorf("%s %q", errorConfigUnknownMethod, method))
 		}
+	}
+
+	if len(cfg.Headers) == 0 {
+		cfg.Headers = m.DefaultHeaders
+	}
+
+	// The flat shape had no headers, so origins given in it may still request the CORS-safelisted ones.
+	if len(cfg.Headers) == 0 && cfg.methodsOnly {
+		cfg.Headers = defaultSimpleHeaders
+	}
+
+	for _, name := range cfg.ExposedHeaders {
+		if name != allToken && !isToken(strings.TrimSpace(name)) {
+			errs = append(errs, fmt.Errorf("exposed_headers: %s %q", errorConfigHeaderName, name))
+		}
+	}
+
+	if len(cfg.Headers) == 0 {
+		errs = append(errs, errors.New(errorConfigHeader))
+	}
+
+	if cfg.MaxAge < 0 {
+		errs = append(errs, errors.New(errorConfigMaxAge))
+	}
 
-		cfg.Headers = canonicalHeaders
+	var schemes []string
+	for _, scheme := range cfg.Schemes {
+		if scheme == "" {
+			errs = append(errs, errors.New(errorConfigScheme))
+			break
+		}
+
+		schemes = append(schemes, strings.ToLower(scheme))
+	}
+
+	var canonicalHeaders []string
+	for _, h := range cfg.Headers {
+		canonicalHeaders = append(canonicalHeaders, http.CanonicalHeaderKey(h))
+	}
+
+	cfg.Schemes = schemes
+	cfg.Headers = canonicalHeaders
+	return errs
+}
+
+// Replaces "@group" references in the methods of an origin with the methods of that group, dropping duplicates.
+// Methods are trimmed and uppercased.
+func expandMethods(cfg *host, groups map[string][]string) error {
+	var err error
+	var methods []string
+	for _, method := range cfg.Methods {
+		expanded := []string{method}
+		if strings.HasPrefix(method, groupPrefix) {
+			group, ok := groups[strings.TrimPrefix(method, groupPrefix)]
+			if !ok {
+				err = fmt.Errorf("%s %s", errorConfigGroup, method)
+				continue
+			}
+
+			expanded = group
+		}
+
+		for _, m := range expanded {
+			m = strings.ToUpper(strings.TrimSpace(m))
+			if !stringInSlice(m, methods) {
+				methods = append(methods, m)
+			}
+		}
 	}
 
-	return true, nil
+	cfg.Methods = methods
+	return err
 }
@@ -0,0 +1,283 @@
+package cors
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Change is a single difference between two configurations.
+type Change struct {
+	Origin   string // the origin key or "default_policy", empty for global settings
+	Field    string // the setting that changed, empty when the whole origin was added or removed
+	Old      string // the old value, empty when the origin was added
+	New      string // the new value, empty when the origin was removed
+	Breaking bool   // whether requests allowed by the old configuration may be denied by the new one
+}
+
+// String describes the change on a single line.
+func (c Change) String() string {
+	var s string
+	switch {
+	case c.Field == "" && c.New == "":
+		s = fmt.Sprintf("- %s {%s}", c.Origin, c.Old)
+	case c.Field == "" && c.Old == "":
+		s = fmt.Sprintf("+ %s {%s}", c.Origin, c.New)
+	case c.Origin == "":
+		s = fmt.Sprintf("~ %s: %s -> %s", c.Field, c.Old, c.New)
+	default:
+		s = fmt.Sprintf("~ %s %s: %s -> %s", c.Origin, c.Field, c.Old, c.New)
+	}
+
+	if c.Breaking {
+		s += " (breaking)"
+	}
+
+	return s
+}
+
+// Diff lists the differences between two validated configurations: origins in key order,
+// the fallback policies, the rules of each named policy, then global settings. A global setting that Diff does not
+// know how to compare is reported as breaking whenever it changes.
+func Diff(old, new *Middleware) []Change {
+	// Origin patterns are among the origin keys once the configuration is validated.
+	changes := diffHosts(old, new, old.AllowedOrigins, new.AllowedOrigins)
+
+	changes = append(changes, diffHost(defaultPolicyRule, old, new, old.DefaultPolicy, new.DefaultPolicy)...)
+	changes = append(changes, diffHost(nullOriginRule, old, new, old.AllowNullOrigin, new.AllowNullOrigin)...)
+	changes = append(changes, diffHost(suffixPolicyRule, old, new, old.SuffixPolicy, new.SuffixPolicy)...)
+	changes = append(changes, diffHost(etcdPolicyRule, old, new, old.EtcdPolicy, new.EtcdPolicy)...)
+	changes = append(changes, diffPolicies(old, new)...)
+
+	settings := []struct {
+		field    string
+		old, new interface{}
+		breaking bool
+	}{
+		{"global_methods", joinSorted(old.GlobalMethods), joinSorted(new.GlobalMethods), narrows(new.GlobalMethods, old.GlobalMethods)},
+		{"policy_routes", joinRoutes(old.PolicyRoutes), joinRoutes(new.PolicyRoutes), !routesKept(old.PolicyRoutes, new.PolicyRoutes)},
+		{"origin_suffixes", joinSorted(old.suffixes), joinSorted(new.suffixes), !coversAll(new.suffixes, old.suffixes)},
+		{"simple_headers", joinSorted(old.simpleHeaders()), joinSorted(new.simpleHeaders()), !headersCoverAll(new.simpleHeaders(), old.simpleHeaders())},
+		{"timing_allow_origins", joinSorted(old.TimingAllowOrigins), joinSorted(new.TimingAllowOrigins), !coversAll(new.TimingAllowOrigins, old.TimingAllowOrigins)},
+		{"default_max_age", old.DefaultMaxAge, new.DefaultMaxAge, false},
+		{"preflight_status", old.preflightStatus(), new.preflightStatus(), false},
+		{"allow_private_network", old.AllowPrivateNetwork, new.AllowPrivateNetwork, old.AllowPrivateNetwork},
+		{"https_only", old.HTTPSOnly, new.HTTPSOnly, new.HTTPSOnly},
+		{"ignore_origin_case", old.IgnoreOriginCase, new.IgnoreOriginCase, old.IgnoreOriginCase},
+		{"require_origin", old.RequireOrigin, new.RequireOrigin, new.RequireOrigin},
+		{"reject_forbidden_headers", old.RejectForbiddenHeaders, new.RejectForbiddenHeaders, new.RejectForbiddenHeaders},
+		{"apply_header", old.ApplyHeader, new.ApplyHeader, true},
+		{"apply_value", old.ApplyValue, new.ApplyValue, true},
+		{"origin_header", old.OriginHeader, new.OriginHeader, true},
+		{"deny_status", old.denyStatus(), new.denyStatus(), true},
+		{"stealth_deny", old.StealthDeny, new.StealthDeny, true},
+		{"stealth_status", old.stealthStatus(), new.stealthStatus(), old.StealthDeny || new.StealthDeny},
+		{"report_only", old.ReportOnly, new.ReportOnly, old.ReportOnly},
+		{"literal_wildcard", old.LiteralWildcard, new.LiteralWildcard, false},
+		{"strict_head", old.StrictHead, new.StrictHead, new.StrictHead},
+		{"debug", old.Debug, new.Debug, false},
+		{"json_logs", old.JSONLogs, new.JSONLogs, false},
+		{"log_file", old.LogFile, new.LogFile, false},
+	}
+
+	known := map[string]bool{
+		"origins": true, "origin_patterns": true, "default_policy": true, "allow_null_origin": true,
+		"suffix_policy": true, "suffix_file": true, "etcd_policy": true, "policies": true,
+		// The per-origin changes already cover these.
+		"method_groups": true, "default_methods": true, "default_headers": true, "exposed_headers": true, "default_exposed_headers": true,
+	}
+	for _, s := range settings {
+		known[s.field] = true
+		if s.old != s.new {
+			changes = append(changes, Change{Field: s.field, Old: fmt.Sprint(s.old), New: fmt.Sprint(s.new), Breaking: s.breaking})
+		}
+	}
+
+	return append(changes, diffOtherSettings(old, new, known)...)
+}
+
+// Compares two sets of origin configurations by key.
+func diffHosts(oldCfg, newCfg *Middleware, old, new map[string]*host) []Change {
+	keys := map[string]bool{}
+	for origin := range old {
+		keys[origin] = true
+	}
+	for origin := range new {
+		keys[origin] = true
+	}
+
+	origins := make([]string, 0, len(keys))
+	for origin := range keys {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+
+	var changes []Change
+	for _, origin := range origins {
+		changes = append(changes, diffHost(origin, oldCfg, newCfg, old[origin], new[origin])...)
+	}
+
+	return changes
+}
+
+// Compares the origins of the named policies, prefixing their changes with "policies.<name>". A removed policy is breaking.
+func diffPolicies(old, new *Middleware) []Change {
+	keys := map[string]bool{}
+	for name := range old.Policies {
+		keys[name] = true
+	}
+	for name := range new.Policies {
+		keys[name] = true
+	}
+
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var changes []Change
+	for _, name := range names {
+		oldPolicy, newPolicy := old.policies[name], new.policies[name]
+		switch {
+		case newPolicy == nil:
+			changes = append(changes, Change{Origin: policiesPrefix + name, Old: joinKeys(oldPolicy.AllowedOrigins), Breaking: true})
+		case oldPolicy == nil:
+			changes = append(changes, Change{Origin: policiesPrefix + name, New: joinKeys(newPolicy.AllowedOrigins)})
+		default:
+			for _, change := range diffHosts(oldPolicy, newPolicy, oldPolicy.AllowedOrigins, newPolicy.AllowedOrigins) {
+				change.Origin = policiesPrefix + name + " " + change.Origin
+				changes = append(changes, change)
+			}
+		}
+	}
+
+	return changes
+}
+
+// Reports a breaking change for every setting that is not known to the caller and differs.
+func diffOtherSettings(old, new *Middleware, known map[string]bool) []Change {
+	var changes []Change
+
+	oldValue, newValue := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := strings.Split(oldValue.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if field == "" || field == "-" || known[field] {
+			continue
+		}
+
+		oldSetting, newSetting := oldValue.Field(i).Interface(), newValue.Field(i).Interface()
+		if reflect.DeepEqual(oldSetting, newSetting) {
+			continue
+		}
+
+		oldJSON, _ := json.Marshal(oldSetting)
+		newJSON, _ := json.Marshal(newSetting)
+		changes = append(changes, Change{Field: field, Old: string(oldJSON), New: string(newJSON), Breaking: true})
+	}
+
+	return changes
+}
+
+// Joins the origin keys in sorted order.
+func joinKeys(origins map[string]*host) string {
+	keys := make([]string, 0, len(origins))
+	for origin := range origins {
+		keys = append(keys, origin)
+	}
+
+	return joinSorted(keys)
+}
+
+// Joins the policy routes as sorted "path=policy" pairs.
+func joinRoutes(routes map[string]string) string {
+	pairs := make([]string, 0, len(routes))
+	for path, policy := range routes {
+		pairs = append(pairs, path+"="+policy)
+	}
+
+	return joinSorted(pairs)
+}
+
+// Reports whether every old route still leads to the same policy.
+func routesKept(old, new map[string]string) bool {
+	for path, policy := range old {
+		if new[path] != policy {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Compares the configuration of a single origin, either of which may be nil.
+func diffHost(origin string, oldCfg, newCfg *Middleware, old, new *host) []Change {
+	switch {
+	case old == nil && new == nil:
+		return nil
+	case new == nil:
+		return []Change{{Origin: origin, Old: old.String(), Breaking: true}}
+	case old == nil:
+		return []Change{{Origin: origin, New: new.String()}}
+	}
+
+	var changes []Change
+	add := func(field string, oldValue, newValue string, breaking bool) {
+		if oldValue != newValue {
+			changes = append(changes, Change{Origin: origin, Field: field, Old: oldValue, New: newValue, Breaking: breaking})
+		}
+	}
+
+	add("methods", joinSorted(old.Methods), joinSorted(new.Methods), !coversAll(new.Methods, old.Methods))
+	add("headers", joinSorted(old.Headers), joinSorted(new.Headers), !headersCoverAll(new.Headers, old.Headers))
+	add("max_age", strconv.FormatInt(oldCfg.maxAge(old), 10), strconv.FormatInt(newCfg.maxAge(new), 10), false)
+	add("enabled", strconv.FormatBool(old.enabled()), strconv.FormatBool(new.enabled()), old.enabled() && !new.enabled())
+	add("schemes", joinSorted(old.Schemes), joinSorted(new.Schemes), narrows(new.Schemes, old.Schemes))
+	add("credentials", strconv.FormatBool(old.Credentials), strconv.FormatBool(new.Credentials), old.Credentials && !new.Credentials)
+	add("allow_private_network", strconv.FormatBool(old.AllowPrivateNetwork), strconv.FormatBool(new.AllowPrivateNetwork), old.AllowPrivateNetwork && !new.AllowPrivateNetwork)
+	add("timing_allow_origin", strconv.FormatBool(old.TimingAllowOrigin), strconv.FormatBool(new.TimingAllowOrigin), false)
+	add("exposed_headers", oldCfg.originExposedHeaders(old, origin), newCfg.originExposedHeaders(new, origin), false)
+	add("suppress_headers", strconv.FormatBool(old.SuppressHeaders), strconv.FormatBool(new.SuppressHeaders), false)
+
+	return changes
+}
+
+// Reports whether every value of a is allowed by b, where "*" allows anything.
+func coversAll(b, a []string) bool {
+	if stringInSlice(allToken, b) {
+		return true
+	}
+
+	for _, v := range a {
+		if !stringInSlice(v, b) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reports whether b allows less than a, for lists where an empty one allows anything.
+func narrows(b, a []string) bool {
+	return len(b) > 0 && (len(a) == 0 || !coversAll(b, a))
+}
+
+// Reports whether every header of a is allowed by b. Like at runtime, "*" does not stand for Authorization.
+func headersCoverAll(b, a []string) bool {
+	if stringInSlice(authorizationHeader, a) && !stringInSlice(authorizationHeader, b) {
+		return false
+	}
+
+	return coversAll(b, a)
+}
+
+// Joins a copy of the values in sorted order.
+func joinSorted(values []string) string {
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+
+	return strings.Join(sorted, ",")
+}
@@ -0,0 +1,210 @@
+package cors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Origins read from etcd, shared by every configuration of a handler so that reloading the file keeps them.
+type dynamicOrigins struct {
+	mu      sync.RWMutex
+	origins map[string]bool
+}
+
+func (d *dynamicOrigins) has(origin string) bool {
+	if d == nil {
+		return false
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.origins[origin]
+}
+
+func (d *dynamicOrigins) count() int {
+	if d == nil {
+		return 0
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.origins)
+}
+
+func (d *dynamicOrigins) set(origins map[string]bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.origins = origins
+}
+
+// A response of the etcd v2 keys API.
+type etcdResponse struct {
+	ErrorCode int      `json:"errorCode"`
+	Message   string   `json:"message"`
+	Node      etcdNode `json:"node"`
+}
+
+type etcdNode struct {
+	Key   string     `json:"key"`
+	Value string     `json:"value"`
+	Dir   bool       `json:"dir"`
+	Nodes []etcdNode `json:"nodes"`
+}
+
+// Keeps the origins under m.EtcdPrefix up to date until the handler is closed or stopEtcd is called,
+// replacing any watcher already running. Each key holds one origin.
+// When etcd cannot be reached the origins last read stay allowed and it is retried after watchRetryDelay.
+func (h *Handler) watchEtcd(m *Middleware) {
+	origins := m.dynamic
+	endpoints := m.EtcdEndpoints
+	prefix := m.EtcdPrefix
+
+	h.stopEtcd()
+	stop := make(chan struct{})
+	h.mu.Lock()
+	h.etcdStop = stop
+	h.mu.Unlock()
+
+	h.background(func(done <-chan struct{}) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-done:
+				cancel()
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}}
+		for ctx.Err() == nil {
+			logger := h.config().logger()
+
+			allowed, index, err := fetchEtcdOrigins(ctx, client, endpoints, prefix, logger.Printf)
+			if err == nil {
+				origins.set(allowed)
+				h.decisions.reset()
+				logger.Printf("CORS loaded %d origins from etcd %s\n", len(allowed), prefix)
+
+				// Wait for the next change, then read the whole prefix again.
+				err = waitEtcd(ctx, client, endpoints, prefix, index+1)
+			}
+
+			if err != nil && ctx.Err() == nil {
+				logger.Printf("CORS reading etcd %s failed, keeping the previous origins: %v\n", prefix, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(watchRetryDelay):
+				}
+			}
+		}
+	})
+}
+
+// Stops the etcd watcher, if any, e.g. because a reloaded configuration no longer reads the same prefix.
+func (h *Handler) stopEtcd() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.etcdStop != nil {
+		close(h.etcdStop)
+		h.etcdStop = nil
+	}
+}
+
+// Reads the origins stored under the prefix and the etcd index they were read at.
+// A missing prefix allows no origins. Values that are not plain origins are reported and skipped.
+func fetchEtcdOrigins(ctx context.Context, client *http.Client, endpoints []string, prefix string, logf func(string, ...interface{})) (map[string]bool, uint64, error) {
+	res, index, err := getEtcd(ctx, client, endpoints, prefix, url.Values{"recursive": {trueToken}})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	origins := map[string]bool{}
+	if res.ErrorCode == etcdKeyNotFound {
+		return origins, index, nil
+	}
+
+	var collect func(node etcdNode)
+	collect = func(node etcdNode) {
+		if node.Dir {
+			for _, child := range node.Nodes {
+				collect(child)
+			}
+			return
+		}
+
+		origin := strings.TrimSpace(node.Value)
+		// Keys are matched exactly, so wildcards, hosts and patterns have no meaning here.
+		if origin == nullOrigin || strings.Contains(origin, allToken) || !isValidOrigin(origin) || validateOriginKey(origin) != nil {
+			logf("CORS ignoring etcd key %s: %q is not an origin\n", node.Key, origin)
+			return
+		}
+
+		origins[origin] = true
+	}
+	collect(res.Node)
+
+	return origins, index, nil
+}
+
+// Blocks until a key under the prefix changes after the given etcd index, or the context is cancelled.
+func waitEtcd(ctx context.Context, client *http.Client, endpoints []string, prefix string, index uint64) error {
+	query := url.Values{
+		"wait":      {trueToken},
+		"recursive": {trueToken},
+		"waitIndex": {strconv.FormatUint(index, 10)},
+	}
+
+	// An index that etcd no longer remembers is answered with an error, which also means reading the prefix again.
+	_, _, err := getEtcd(ctx, client, endpoints, prefix, query)
+	return err
+}
+
+// Queries the keys API of the first endpoint that answers. Returns the response with the X-Etcd-Index it was made at.
+func getEtcd(ctx context.Context, client *http.Client, endpoints []string, prefix string, query url.Values) (*etcdResponse, uint64, error) {
+	var errs []string
+	for _, endpoint := range endpoints {
+		rawURL := strings.TrimSuffix(endpoint, "/") + "/v2/keys/" + strings.TrimPrefix(prefix, "/") + "?" + query.Encode()
+
+		req, err := http.NewRequest(getMethod, rawURL, nil)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		res, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, 0, ctx.Err()
+			}
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		var body etcdResponse
+		err = json.NewDecoder(res.Body).Decode(&body)
+		res.Body.Close()
+
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Sprintf("%s: %s", endpoint, res.Status))
+		case body.ErrorCode != 0 && body.ErrorCode != etcdKeyNotFound:
+			return nil, 0, fmt.Errorf("%s: %s", endpoint, body.Message)
+		default:
+			index, _ := strconv.ParseUint(res.Header.Get(etcdIndexHeader), 10, 64)
+			return &body, index, nil
+		}
+	}
+
+	return nil, 0, fmt.Errorf("%s: %s", errorFileIO, strings.Join(errs, "; "))
+}
@@ -1,104 +1,591 @@
 package cors
 
 import (
+	"encoding/json"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Handler executes CORS and handles the middleware chain to the next in stack
 type Handler struct {
-	cfg  Middleware
-	next http.Handler
+	cfg       atomic.Value // holds a *Middleware
+	next      http.Handler
+	denials   denialThrottle
+	limiter   denialLimiter
+	decisions decisionCache
+
+	mu         sync.Mutex
+	done       chan struct{} // closed by Close to stop background work
+	closeOnce  sync.Once
+	workers    sync.WaitGroup // background work still running
+	reloadErr  error          // error of the last failed reload, nil once one succeeds
+	reloadTime time.Time      // time of the last reload attempt
+	etcdStop   chan struct{}  // closed to stop the etcd watcher, nil when none runs
+}
+
+// Status reports whether a handler has a usable configuration.
+type Status struct {
+	OK             bool      `json:"ok"`
+	OriginCount    int       `json:"origin_count"`
+	LastReloadErr  string    `json:"last_reload_error,omitempty"`
+	LastReloadTime time.Time `json:"last_reload_time"`
+}
+
+// SetConfig atomically replaces the configuration used for subsequent requests.
+// Requests already in flight finish with the configuration they started with.
+func (h *Handler) SetConfig(m *Middleware) {
+	cfg := *m
+	h.cfg.Store(&cfg)
+	h.decisions.reset()
+	h.reloaded(nil)
+}
+
+// Records the outcome of loading a configuration. A failed reload keeps the previous configuration in use.
+func (h *Handler) reloaded(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.reloadErr = err
+	h.reloadTime = time.Now()
+}
+
+// Status reports the configuration in use and the outcome of the last reload.
+func (h *Handler) Status() Status {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var status Status
+	if cfg, ok := h.cfg.Load().(*Middleware); ok {
+		status.OriginCount = len(cfg.AllowedOrigins) + cfg.dynamic.count()
+	}
+
+	status.LastReloadTime = h.reloadTime
+	if h.reloadErr != nil {
+		status.LastReloadErr = h.reloadErr.Error()
+	}
+
+	status.OK = status.OriginCount > 0 && h.reloadErr == nil
+	return status
+}
+
+// StatusHandler serves the status as JSON for readiness probes, with a 503 when it is not OK.
+// It is meant to be mounted on its own route, apart from the proxied requests.
+func (h *Handler) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := h.Status()
+
+		w.Header().Set(contentTypeHeader, jsonContentType)
+		if !status.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		json.NewEncoder(w).Encode(status)
+	})
+}
+
+// Close stops the background work of the handler, such as watching the configuration, and waits for it to finish.
+// Requests are still served with the last configuration. Closing more than once is harmless.
+func (h *Handler) Close() error {
+	h.closeOnce.Do(func() {
+		close(h.stopped())
+	})
+
+	h.workers.Wait()
+
+	// Denials left out of the logs are summarized now rather than after the interval.
+	if cfg, ok := h.cfg.Load().(*Middleware); ok {
+		h.denials.close(cfg)
+	}
+
+	return nil
+}
+
+// Runs f in the background until the handler is closed. f must return soon after done is closed.
+func (h *Handler) background(f func(done <-chan struct{})) {
+	h.workers.Add(1)
+	go func() {
+		defer h.workers.Done()
+		f(h.stopped())
+	}()
+}
+
+// Returns the channel that is closed when the handler is closed.
+func (h *Handler) stopped() chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.done == nil {
+		h.done = make(chan struct{})
+	}
+
+	return h.done
+}
+
+// Returns the current configuration.
+func (h *Handler) config() *Middleware {
+	return h.cfg.Load().(*Middleware)
 }
 
 // Runs the CORS specification on the request before passing it to the next middleware chain
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.prepResponse(w)
+	cfg := h.config()
+	if !cfg.applies(r) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
 
-	if r.Method == optionsMethod {
-		h.handlePreflight(w, r)
-		w.WriteHeader(http.StatusOK)
+	h.prepResponse(cfg, w, r)
+
+	// Same-origin and server-to-server requests carry no origin, so there is nothing to check.
+	if !cfg.RequireOrigin && cfg.requestOrigin(r) == "" {
+		h.serveNext(w, r)
 		return
 	}
 
-	h.handleRequest(w, r)
-	h.next.ServeHTTP(w, r)
+	if cfg.isPreflight(r) {
+		if h.handlePreflight(cfg, w, r) {
+			w.Header().Set(contentLengthHeader, "0")
+			w.WriteHeader(cfg.preflightStatus())
+		}
+		return
+	}
+
+	if h.handleRequest(cfg, w, r) {
+		h.serveNext(w, r)
+	}
 }
 
-// Runs the CORS specification for OPTION requests
-func (h *Handler) handlePreflight(w http.ResponseWriter, r *http.Request) {
-	method := r.Header.Get(requestMethodHeader)
-	if method == "" {
-		method = r.Method
+// Passes the request on to the next handler, keeping the Vary header set for CORS.
+func (h *Handler) serveNext(w http.ResponseWriter, r *http.Request) {
+	vw := &varyWriter{ResponseWriter: w}
+	h.next.ServeHTTP(vw, r)
+
+	// The server sends the headers itself when the next handler wrote nothing.
+	if !vw.wroteHeader {
+		mergeVary(w.Header())
 	}
+}
 
-	h.handleMaxAge(w, r)
+// Runs the CORS specification for OPTION requests. Returns false when the request was denied.
+func (h *Handler) handlePreflight(cfg *Middleware, w http.ResponseWriter, r *http.Request) bool {
+	// The requested method must be present and allowed; an empty one is denied as a bad method.
+	method := r.Header.Get(requestMethodHeader)
+
+	allowedOrigin := h.handleCommon(cfg, w, r, PreflightPhase, method)
+	if allowedOrigin == nil {
+		return false
+	}
 
-	h.handleCommon(w, r, method)
+	if !allowedOrigin.SuppressHeaders {
+		h.handleMaxAge(cfg, w, allowedOrigin)
+		h.handlePrivateNetwork(cfg, w, r, allowedOrigin)
+	}
+	return true
 }
 
-func (h *Handler) handleMaxAge(w http.ResponseWriter, r *http.Request) {
-	maxAge := strconv.Itoa(int(h.cfg.maxAgeForOrigin(r.Header.Get(originHeader))))
+func (h *Handler) handleMaxAge(cfg *Middleware, w http.ResponseWriter, allowedOrigin *host) {
+	maxAge := allowedOrigin.maxAge
+	if maxAge == "" {
+		maxAge = strconv.Itoa(int(cfg.maxAge(allowedOrigin)))
+	}
 
 	w.Header().Set(maxAgeHeader, maxAge)
 }
 
-// Runs the CORS specification for standard requests
-func (h *Handler) handleRequest(w http.ResponseWriter, r *http.Request) {
+// Answers Private Network Access preflights when enabled for the middleware or the origin, otherwise lets the browser block them
+func (h *Handler) handlePrivateNetwork(cfg *Middleware, w http.ResponseWriter, r *http.Request, allowedOrigin *host) {
+	enabled := cfg.AllowPrivateNetwork || allowedOrigin.AllowPrivateNetwork
+	if enabled && r.Header.Get(requestPrivateNetworkHeader) == trueToken {
+		w.Header().Set(allowPrivateNetworkHeader, trueToken)
+	}
+}
+
+// Runs the CORS specification for standard requests. Returns false when the request was denied.
+func (h *Handler) handleRequest(cfg *Middleware, w http.ResponseWriter, r *http.Request) bool {
 	method := r.Method
-	h.handleCommon(w, r, method)
+	allowedOrigin := h.handleCommon(cfg, w, r, RequestPhase, method)
+	if allowedOrigin == nil {
+		return false
+	}
+
+	h.handleTimingAllowOrigin(cfg, w, r, allowedOrigin)
+	return true
+}
+
+// Lets the Resource Timing API expose detailed timings to the origins configured for it
+func (h *Handler) handleTimingAllowOrigin(cfg *Middleware, w http.ResponseWriter, r *http.Request, allowedOrigin *host) {
+	origin := cfg.requestOrigin(r)
+	switch {
+	case allowedOrigin.TimingAllowOrigin, stringInSlice(origin, cfg.TimingAllowOrigins):
+		w.Header().Set(timingAllowOriginHeader, origin)
+	case stringInSlice(allToken, cfg.TimingAllowOrigins):
+		w.Header().Set(timingAllowOriginHeader, allToken)
+	}
 }
 
-// Shares common functionality for prefilght and standard requests
-func (h *Handler) handleCommon(w http.ResponseWriter, r *http.Request, method string) {
-	origin := r.Header.Get(originHeader)
-	if !h.cfg.isOriginAllowed(origin) {
-		h.requestDenied(w, r, errorBadOrigin)
+// Shares common functionality for prefilght and standard requests.
+// Returns the configuration of the allowed origin, or nil when the request was denied.
+func (h *Handler) handleCommon(cfg *Middleware, w http.ResponseWriter, r *http.Request, phase Phase, method string) *host {
+	cfg = cfg.policyFor(r)
+	origin := cfg.requestOrigin(r)
+	if !isValidOrigin(origin) {
+		return h.requestDenied(cfg, w, r, phase, errorBadOrigin, "")
+	}
+
+	requested := requestedHeaders(r)
+	key := decisionKey{cfg, phase, origin, method, requested}
+	if d, ok := h.decisions.get(key); ok {
+		return h.requestDenied(cfg, w, r, phase, d.reason, d.rule)
+	}
+
+	deny := func(m string, rule string) *host {
+		h.decisions.add(key, m, rule)
+		return h.requestDenied(cfg, w, r, phase, m, rule)
+	}
+
+	allowedOrigin, rule := cfg.findOrigin(origin)
+	if allowedOrigin == nil {
+		return deny(errorBadOrigin, rule)
+	}
+
+	if !allowedOrigin.enabled() {
+		if cfg.Debug {
+			cfg.logger().Printf("CORS origin %v is disabled by rule %q\n", origin, rule)
+		}
+
+		return deny(errorBadOrigin, rule)
+	}
+
+	if len(allowedOrigin.Methods) == 0 {
+		return deny(errorEmptyMethods, rule)
+	}
+
+	if !allowedOrigin.schemeAllowed(origin) || cfg.HTTPSOnly && !strings.HasPrefix(strings.ToLower(origin), httpsScheme+"://") {
+		return deny(errorBadScheme, rule)
+	}
+
+	if !cfg.isMethodAllowed(method, allowedOrigin) {
+		return deny(errorBadMethod, rule)
+	}
+
+	headers, ok := parseRequestedHeaders(r)
+	if !ok {
+		return deny(errorBadHeader, rule)
+	}
+
+	if phase == PreflightPhase && cfg.Metrics != nil {
+		cfg.Metrics.ObserveRequestedHeaders(len(headers))
+	}
+
+	if phase == PreflightPhase && cfg.RejectForbiddenHeaders && cfg.hasForbiddenHeader(headers) {
+		return deny(errorForbiddenHeader, rule)
+	}
+
+	if !cfg.areHeadersAllowed(headers, allowedOrigin) {
+		return deny(errorBadHeader, rule)
+	}
+
+	if cfg.Debug {
+		cfg.logger().Printf("CORS allowed %v %v from %v by rule %q\n", method, r.URL.Path, origin, rule)
+	}
+
+	if allowedOrigin.SuppressHeaders {
+		return allowedOrigin
+	}
+
+	allowOrigin := origin
+	if cfg.LiteralWildcard && rule == allToken && !allowedOrigin.Credentials {
+		// Every origin gets the same answer from "*", so the response can be cached regardless of Origin.
+		// Browsers refuse credentialed responses allowing a literal "*", so those keep reflecting the origin.
+		allowOrigin = allToken
+		dropVary(w.Header(), originHeader)
+	}
+
+	methods := method
+	if phase == PreflightPhase {
+		// Listing every allowed method spares the browser another preflight for the next one.
+		methods = cfg.allowedMethods(method, allowedOrigin)
+	}
+
+	// Exposing headers only matters to the actual response.
+	if phase == RequestPhase {
+		if exposed := cfg.originExposedHeaders(allowedOrigin, rule); exposed != "" {
+			w.Header().Set(exposeHeadersHeader, exposed)
+		}
+	}
+
+	h.buildResponse(w, r, allowOrigin, methods, headers)
+	if allowedOrigin.Credentials {
+		// Validation rejects credentials on rules matching any origin, but configurations set directly are not validated.
+		if broadRule(rule) {
+			cfg.logger().Printf("CORS not allowing credentials to %v matched by %q, which matches more than one exact origin\n", origin, rule)
+		} else {
+			w.Header().Set(allowCredentialsHeader, trueToken)
+		}
+	}
+
+	return allowedOrigin
+}
+
+// Stable values of the denial reason header by error message.
+var denialReasons = map[string]string{
+	errorBadOrigin:       "bad_origin",
+	errorBadScheme:       "bad_scheme",
+	errorBadMethod:       "bad_method",
+	errorBadHeader:       "bad_header",
+	errorForbiddenHeader: "forbidden_header",
+	errorEmptyMethods:    "empty_methods",
+	errorThrottled:       "throttled",
+}
+
+// Sets the HTTP status to the deny status (or too many requests when the client is throttled), counts the denial and logs it unless too many were logged recently.
+// Returns nil, or the configuration to answer with as if allowed when only reporting denials.
+func (h *Handler) requestDenied(cfg *Middleware, w http.ResponseWriter, r *http.Request, phase Phase, m string, rule string) *host {
+	// Only requests the policy denies are throttled, so a client cannot get an origin's allowed requests refused.
+	client := cfg.clientAddress(r)
+	if wait := h.limiter.wait(cfg, client); wait > 0 {
+		if !cfg.OmitRetryAfter {
+			w.Header().Set(retryAfterHeader, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		}
+
+		m, rule = errorThrottled, ""
+	} else {
+		h.limiter.record(cfg, client)
+	}
+
+	if cfg.Metrics != nil {
+		cfg.Metrics.IncDenied(denialReasons[m], phase)
+	}
+
+	if cfg.OnDenied != nil {
+		cfg.OnDenied(r, Denial{Phase: phase, Reason: denialReasons[m], Origin: cfg.requestOrigin(r), Rule: rule})
+	}
+
+	if h.denials.allow(cfg, m) {
+		h.logDenial(cfg, r, phase, m, rule)
+	}
+
+	if cfg.ReportOnly {
+		w.Header().Set(cfg.reportHeader(), "would-deny; reason="+denialReasons[m])
+		return h.reportOnly(cfg, w, r, phase)
+	}
+
+	status := cfg.denyStatus()
+	if m == errorThrottled {
+		status = http.StatusTooManyRequests
+	}
+
+	if cfg.StealthDeny {
+		// Look like any other missing route: no CORS headers, no reason and no body.
+		for name := range w.Header() {
+			if strings.HasPrefix(name, accessControlPrefix) {
+				w.Header().Del(name)
+			}
+		}
+		w.Header().Del(varyHeader)
+		w.Header().Del(retryAfterHeader)
+
+		w.WriteHeader(cfg.stealthStatus())
+		return nil
+	}
+
+	if cfg.ExposeDenialReason {
+		w.Header().Set(deniedReasonHeader, denialReasons[m])
+	}
+
+	if !cfg.DenyBody {
+		w.WriteHeader(status)
+		return nil
+	}
+
+	body, _ := json.Marshal(denialBody{"cors_denied", denialReasons[m], cfg.requestOrigin(r)})
+	w.Header().Set(contentTypeHeader, cfg.denyContentType())
+	w.Header().Set(contentLengthHeader, strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+	return nil
+}
+
+// denialBody is the body of denied responses with DenyBody.
+type denialBody struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+	Origin string `json:"origin"`
+}
+
+// reportOnlyHost answers denied requests when only reporting them: everything they asked for, with the default max age.
+var reportOnlyHost = &host{}
+
+// Writes the Access Control headers a denied request would have needed to be allowed.
+func (h *Handler) reportOnly(cfg *Middleware, w http.ResponseWriter, r *http.Request, phase Phase) *host {
+	method := r.Method
+	if phase == PreflightPhase {
+		method = r.Header.Get(requestMethodHeader)
+	} else if exposed := cfg.exposedHeaders(""); exposed != "" {
+		w.Header().Set(exposeHeadersHeader, exposed)
+	}
+
+	if origin := cfg.requestOrigin(r); origin != "" {
+		headers, _ := parseRequestedHeaders(r)
+		h.buildResponse(w, r, origin, method, headers)
+	}
+
+	return reportOnlyHost
+}
+
+// Logs the error message along with the rule the origin matched and the request details.
+func (h *Handler) logDenial(cfg *Middleware, r *http.Request, phase Phase, m string, rule string) {
+	logger := cfg.logger()
+	if cfg.JSONLogs {
+		logJSON(logger, denialEvent{
+			Event:   "cors_denied",
+			Reason:  denialReasons[m],
+			Phase:   phase,
+			Origin:  cfg.requestOrigin(r),
+			Rule:    rule,
+			Method:  r.Method,
+			Path:    r.URL.Path,
+			Headers: requestedHeaders(r),
+		})
 		return
 	}
 
-	if !h.cfg.isMethodAllowed(method, origin) {
-		h.requestDenied(w, r, errorBadMethod)
+	logger.Println(errorRoot, m)
+
+	logger.Printf("PHASE: %v\n", phase)
+	logger.Printf("ORIGIN: %q\n", cfg.requestOrigin(r))
+	logger.Printf("RULE: %v\n", rule)
+	logger.Printf("METHOD: %v\n", r.Method)
+
+	headers := requestedHeaders(r)
+	logger.Printf("HEADERS: %v\n\n", headers)
+	for _, h := range parseHeaderList(headers) {
+		h = http.CanonicalHeaderKey(h)
+		logger.Printf("%v: %v\n", h, r.Header.Get(h))
+	}
+}
+
+// denialEvent is a denial as logged by JSONLogs.
+type denialEvent struct {
+	Event   string `json:"event"`
+	Reason  string `json:"reason"`
+	Phase   Phase  `json:"phase"`
+	Origin  string `json:"origin"`
+	Rule    string `json:"rule"`
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	Headers string `json:"headers,omitempty"`
+}
+
+// Logs the event as a single line of JSON, which escapes whatever the request put in it.
+func logJSON(logger *log.Logger, event interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.Printf("%s could not log %T: %v\n", errorRoot, event, err)
 		return
 	}
 
-	headers := r.Header.Get(requestHeadersHeader)
-	if !h.cfg.areHeadersAllowed(strings.Split(headers, ","), origin) {
-		h.requestDenied(w, r, errorBadHeader)
+	logger.Println(string(data))
+}
+
+// Preconfigure headers on the response. Vary is set before deciding so that denials vary on Origin as well.
+// Preflight answers also depend on the requested method and headers, so caches must key on those too.
+func (h *Handler) prepResponse(cfg *Middleware, w http.ResponseWriter, r *http.Request) {
+	w.Header().Add(varyHeader, originHeader)
+	if cfg.isPreflight(r) {
+		w.Header().Add(varyHeader, requestMethodHeader)
+		w.Header().Add(varyHeader, requestHeadersHeader)
+	}
+	mergeVary(w.Header())
+}
+
+// Collapses every Vary header into a single one listing each token once, ignoring case.
+func mergeVary(header http.Header) {
+	values := header[varyHeader]
+	if len(values) == 0 || len(values) == 1 && !strings.Contains(values[0], ",") {
 		return
 	}
 
-	h.buildResponse(w, r, origin, method, headers)
+	var tokens []string
+	seen := map[string]bool{}
+	for _, value := range values {
+		for _, token := range parseHeaderList(value) {
+			if key := strings.ToLower(token); !seen[key] {
+				seen[key] = true
+				tokens = append(tokens, token)
+			}
+		}
+	}
+
+	header.Set(varyHeader, strings.Join(tokens, ", "))
 }
 
-// Sets the HTTP status to forbidden and logs error message
-func (h *Handler) requestDenied(w http.ResponseWriter, r *http.Request, m string) {
-	log.Println(errorRoot, m)
+// Removes a token from the Vary header, dropping the header once it is empty.
+func dropVary(header http.Header, token string) {
+	var tokens []string
+	for _, value := range header[varyHeader] {
+		for _, t := range parseHeaderList(value) {
+			if !strings.EqualFold(t, token) {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+
+	if len(tokens) == 0 {
+		header.Del(varyHeader)
+		return
+	}
+
+	header.Set(varyHeader, strings.Join(tokens, ", "))
+}
 
-	log.Printf("ORIGIN: %v\n", r.Header.Get(originHeader))
-	log.Printf("METHOD: %v\n", r.Method)
+// varyWriter merges the Vary headers added by the next handler with ours before the response is sent.
+type varyWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
 
-	headers := r.Header.Get(requestHeadersHeader)
-	log.Printf("HEADERS: %v\n\n", headers)
-	for _, h := range strings.Split(headers, ",") {
-		h = http.CanonicalHeaderKey(h)
-		log.Printf("%v: %v\n", h, r.Header.Get(h))
+func (w *varyWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		mergeVary(w.Header())
 	}
 
-	w.WriteHeader(http.StatusForbidden)
-	return
+	w.ResponseWriter.WriteHeader(code)
 }
 
-// Preconfigure headers on the response
-func (h *Handler) prepResponse(w http.ResponseWriter) {
-	w.Header().Add(varyHeader, originHeader)
+func (w *varyWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming handlers keep working through the wrapper.
+func (w *varyWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if !w.wroteHeader {
+			w.WriteHeader(http.StatusOK)
+		}
+
+		f.Flush()
+	}
 }
 
-// Writes the Access Control response headers
-func (h *Handler) buildResponse(w http.ResponseWriter, r *http.Request, origin string, method string, headers string) {
+// Writes the Access Control response headers. The origin is the request header verbatim since browsers compare it byte for byte,
+// or "*" for literal wildcard responses.
+func (h *Handler) buildResponse(w http.ResponseWriter, r *http.Request, origin string, methods string, headers []string) {
 	w.Header().Set(allowOriginHeader, origin)
-	w.Header().Set(allowMethodsHeader, method)
-	w.Header().Set(allowHeadersHeader, headers)
+	w.Header().Set(allowMethodsHeader, methods)
+
+	if len(headers) > 0 {
+		w.Header().Set(allowHeadersHeader, strings.Join(headers, ", "))
+	}
 }
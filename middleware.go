@@ -1,82 +1,1083 @@
 package cors
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"net"
+	"os"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	"net/http"
+	"net/url"
 )
 
 // host struct represents a single configuration for an origin.
 type host struct {
-	Methods []string
-	Headers []string
+	Methods stringList
+	Headers stringList
 	MaxAge  int64 `yaml:"max_age"`
+
+	// Enabled can be set to false to block the origin while keeping its configuration. Defaults to true.
+	Enabled *bool `yaml:"enabled"`
+
+	// Schemes restricts the schemes the origin may use, e.g. only "https". Any scheme matching the entry is accepted when empty.
+	Schemes []string `yaml:"schemes"`
+
+	// SuppressHeaders lets allowed requests through without any Access-Control-* response headers,
+	// e.g. for servers calling webhooks, which do not need the policy advertised to them.
+	SuppressHeaders bool `yaml:"suppress_headers"`
+
+	// Credentials answers allowed requests with "Access-Control-Allow-Credentials: true", so that scripts may send
+	// cookies and read the responses to credentialed requests.
+	Credentials bool `yaml:"credentials"`
+
+	// AllowPrivateNetwork answers Private Network Access preflights from this origin, even when the middleware does not.
+	AllowPrivateNetwork bool `yaml:"allow_private_network"`
+
+	// TimingAllowOrigin answers allowed requests from this origin with a matching Timing-Allow-Origin header,
+	// so that origins matched by patterns or subdomain keys get detailed Resource Timing data too.
+	TimingAllowOrigin bool `yaml:"timing_allow_origin"`
+
+	// ExposedHeaders replaces the response headers exposed to this origin by the middleware's ExposedHeaders,
+	// so that each origin can declare its whole policy in one place. An empty list exposes nothing.
+	ExposedHeaders stringList `yaml:"exposed_headers"`
+
+	methodsOnly  bool     // given as a plain list of methods, the flat shape of older configurations
+	methods      []string // methods listed in preflight responses, set by compile
+	allowMethods string   // methods joined for the Access-Control-Allow-Methods header
+	maxAge       string   // value of the Access-Control-Max-Age header
+	exposed      string   // ExposedHeaders joined for the Access-Control-Expose-Headers header
+}
+
+// UnmarshalYAML accepts a plain list of methods as well, e.g. `https://app.example.com: [GET, POST]`,
+// the flat shape of older configurations, and upgrades it to an origin allowing those methods.
+func (h *host) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var methods []string
+	if err := unmarshal(&methods); err == nil {
+		*h = host{Methods: methods, methodsOnly: true}
+		return nil
+	}
+
+	type plain host
+	return unmarshal((*plain)(h))
+}
+
+// UnmarshalJSON accepts a plain list of methods like UnmarshalYAML, so that configurations stored
+// by Vulcand in the flat shape still load through FromOther.
+func (h *host) UnmarshalJSON(data []byte) error {
+	var methods []string
+	if err := json.Unmarshal(data, &methods); err == nil {
+		*h = host{Methods: methods, methodsOnly: true}
+		return nil
+	}
+
+	type plain host
+	return json.Unmarshal(data, (*plain)(h))
+}
+
+// stringList decodes either a list of strings or a single string, so that `headers: "*"` needs no brackets.
+type stringList []string
+
+// UnmarshalYAML accepts a single string as a list holding only that string.
+func (l *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err == nil {
+		*l = nil
+		if value != "" {
+			*l = stringList{value}
+		}
+		return nil
+	}
+
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+
+	*l = list
+	return nil
+}
+
+// Metrics collects observations about handled requests, e.g. to feed a histogram.
+type Metrics interface {
+	// ObserveRequestedHeaders records how many headers a preflight asked for, after trimming.
+	ObserveRequestedHeaders(n int)
+
+	// IncDenied counts a denied request by reason, e.g. "bad_origin", and phase. It is called for every denial, logged or not.
+	IncDenied(reason string, phase Phase)
+}
+
+// Phase tells a preflight apart from the actual request that follows it.
+type Phase string
+
+// Request phases reported with denials.
+const (
+	PreflightPhase Phase = "preflight"
+	RequestPhase   Phase = "request"
+)
+
+// Denial describes a denied request.
+type Denial struct {
+	Phase  Phase
+	Reason string // e.g. "bad_origin", as in the X-CORS-Denied-Reason header
+	Origin string
+	Rule   string // the rule the origin matched, if any
+}
+
+// Matches allowed origin keys written as regular expressions, e.g. `/http://[a-z]+\.skookum\.com/`.
+var regexKey = regexp.MustCompile("^/(.+)/$")
+
+// pattern is an allowed origin key compiled into a regular expression.
+type pattern struct {
+	key string
+	re  *regexp.Regexp
+}
+
+// subdomain is an allowed origin key matching every subdomain of a domain, such as "https://*.example.com".
+type subdomain struct {
+	key    string
+	scheme string // empty for keys without a scheme, which match any scheme
+	suffix string // the lowercase domain after "*", e.g. ".example.com"
+	port   string // empty for the default port, "*" for any
+}
+
+// Splits an origin key whose host starts with "*.", reporting false for other keys.
+// Keys without a scheme match any port, like host-only keys.
+func parseSubdomainKey(key string) (subdomain, bool) {
+	s := subdomain{key: key, port: allToken}
+	rest := key
+	if i := strings.Index(key, "://"); i >= 0 {
+		s.scheme, s.port, rest = strings.ToLower(key[:i]), "", key[i+len("://"):]
+	}
+
+	if !strings.HasPrefix(rest, "*.") {
+		return s, false
+	}
+
+	domain := rest[len(allToken):]
+	if i := strings.LastIndex(domain, ":"); i >= 0 {
+		domain, s.port = domain[:i], domain[i+1:]
+	}
+
+	s.suffix = strings.ToLower(domain)
+	return s, true
 }
 
 // Middleware struct holds configuration parameters.
 type Middleware struct {
-	AllowedOrigins map[string]*host
+	AllowedOrigins map[string]*host `yaml:"origins"`
+
+	// OriginPatterns allows the origins matching these regular expressions, e.g. `https://pr-\d+\.app\.example\.com`.
+	// They are anchored at both ends and behave like origin keys written between slashes.
+	OriginPatterns map[string]*host `yaml:"origin_patterns"`
+
+	// MethodGroups names lists of methods that origins can reference as "@name".
+	MethodGroups map[string][]string `yaml:"method_groups"`
+
+	// GlobalMethods limits every origin to these methods when set, whatever the origin itself allows.
+	GlobalMethods []string `yaml:"global_methods"`
+
+	// KnownMethods replaces the methods origins may list, so that a typo such as "PSOT" fails to load.
+	// Defaults to GET, HEAD, POST, PUT, PATCH, DELETE and OPTIONS.
+	KnownMethods []string `yaml:"known_methods"`
+
+	// EmptyMethods decides what happens to origins listed without methods. By default such a configuration is rejected;
+	// "deny" loads it and denies those origins with their own reason, "default" gives them DefaultMethods instead.
+	EmptyMethods string `yaml:"empty_methods"`
+
+	// DefaultMethods are the methods of origins listed without any when EmptyMethods is "default",
+	// and of every origin when the origins are given as a plain list.
+	DefaultMethods []string `yaml:"default_methods"`
+
+	// DefaultHeaders are the headers of origins listed without any, and of every origin when the origins are given as a plain list.
+	DefaultHeaders []string `yaml:"default_headers"`
+
+	// DefaultMaxAge is the Access-Control-Max-Age of origins without a max_age of their own, in seconds. Defaults to 86400.
+	DefaultMaxAge int64 `yaml:"default_max_age"`
+
+	// DefaultPolicy applies to origins that match no other entry, including "*". Such origins are denied when it is nil.
+	DefaultPolicy *host `yaml:"default_policy"`
+
+	// AllowNullOrigin applies to the opaque "null" origin sent by sandboxed iframes and file:// pages. Neither "*",
+	// patterns nor DefaultPolicy match it, so it is denied when this is nil, unless "null" is listed as an origin.
+	AllowNullOrigin *host `yaml:"allow_null_origin"`
+
+	// PreflightStatus is the status code of successful preflight responses. Defaults to 200.
+	PreflightStatus int `yaml:"preflight_status"`
+
+	// RejectForbiddenHeaders denies preflights requesting a header that browsers never let scripts set, such as Host.
+	RejectForbiddenHeaders bool `yaml:"reject_forbidden_headers"`
+
+	// ForbiddenHeaders replaces the forbidden header names checked by RejectForbiddenHeaders.
+	// Names ending in "-" match every header starting with them. Defaults to the names forbidden by the fetch standard.
+	ForbiddenHeaders []string `yaml:"forbidden_headers"`
+
+	// OriginSuffixes allows every origin whose host ends with one of these domains, e.g. ".corp.example.com" for
+	// "https://app.corp.example.com" but neither "https://corp.example.com" nor "https://evilcorp.example.com".
+	// Origin entries that match take precedence.
+	OriginSuffixes []string `yaml:"origin_suffixes"`
+
+	// SuffixFile names a file listing more origin suffixes, one per line, so that they can be maintained apart
+	// from the rest of the configuration. Blank lines and lines starting with "#" are ignored.
+	SuffixFile string `yaml:"suffix_file"`
+
+	// SuffixPolicy applies to origins allowed by OriginSuffixes or SuffixFile. It is required when there are any.
+	SuffixPolicy *host `yaml:"suffix_policy"`
+
+	// EtcdPrefix names an etcd directory whose keys each hold one allowed origin, e.g. "/cors/origins",
+	// so that an origin can be added with etcdctl instead of a new configuration. The prefix is watched for changes.
+	// Origin entries and suffixes that match take precedence.
+	EtcdPrefix string `yaml:"etcd_prefix"`
+
+	// EtcdEndpoints are the client URLs of the etcd cluster holding EtcdPrefix, e.g. "http://127.0.0.1:2379".
+	EtcdEndpoints []string `yaml:"etcd_endpoints"`
+
+	// EtcdPolicy applies to origins read from EtcdPrefix. It is required with EtcdPrefix.
+	EtcdPolicy *host `yaml:"etcd_policy"`
+
+	// Policies are named maps of origins that replace AllowedOrigins for the requests PolicyRoutes selects them for.
+	// Every other setting is shared, except DefaultPolicy which only applies to AllowedOrigins.
+	Policies map[string]map[string]*host `yaml:"policies"`
+
+	// PolicyRoutes selects a policy by the path prefix of the request, e.g. "/admin/", optionally after a host,
+	// e.g. "admin.example.com/". The longest matching prefix wins. Requests matching none use AllowedOrigins.
+	PolicyRoutes map[string]string `yaml:"policy_routes"`
+
+	// SimpleHeaders replaces the header names every origin may request without listing them in its headers.
+	// Defaults to the CORS-safelisted request headers Accept, Accept-Language and Content-Language.
+	SimpleHeaders []string `yaml:"simple_headers"`
+
+	// ExposedHeaders lists the response headers exposed to an origin, keyed by the rule the origin matched, e.g. its key or "*".
+	// Origins matching no key fall back to "*" and then to DefaultExposedHeaders. An empty list exposes nothing.
+	ExposedHeaders map[string][]string `yaml:"exposed_headers"`
+
+	// DefaultExposedHeaders are the response headers exposed to origins without an entry in ExposedHeaders.
+	DefaultExposedHeaders []string `yaml:"default_exposed_headers"`
+
+	// TimingAllowOrigins lists the origins, or "*", whose allowed requests get a Timing-Allow-Origin header
+	// so that the Resource Timing API exposes detailed timings to them. The header is never sent when empty.
+	TimingAllowOrigins []string `yaml:"timing_allow_origins"`
+
+	// AllowPrivateNetwork answers Private Network Access preflights from every allowed origin.
+	// Leave it off and set allow_private_network on single origins to only answer those.
+	AllowPrivateNetwork bool `yaml:"allow_private_network"`
+
+	// HTTPSOnly denies every origin that does not use https, whatever entry it matches, e.g. "http://example.com"
+	// even when "example.com" is allowed. Origin keys with another scheme are rejected.
+	HTTPSOnly bool `yaml:"https_only"`
+
+	// IgnoreOriginCase matches origins against the allowlist without regard to case.
+	// The origin is still reflected exactly as the browser sent it.
+	IgnoreOriginCase bool `yaml:"ignore_origin_case"`
+
+	// RequireOrigin denies requests without an origin. By default they are passed on, since only cross-origin
+	// requests from browsers carry one.
+	RequireOrigin bool `yaml:"require_origin"`
+
+	// PassPlainOptions treats OPTIONS requests without Access-Control-Request-Method as actual requests and passes
+	// them on when allowed, e.g. for WebDAV or capability discovery. By default every OPTIONS request is a preflight.
+	PassPlainOptions bool `yaml:"pass_plain_options"`
+
+	// ApplyHeader limits CORS to requests carrying this header, e.g. one a gateway sets on traffic from browsers.
+	// Other requests are passed on untouched. CORS applies to every request when it is empty.
+	ApplyHeader string `yaml:"apply_header"`
+
+	// ApplyValue is the value ApplyHeader must have for CORS to apply. Any value does when it is empty.
+	ApplyValue string `yaml:"apply_value"`
+
+	// OriginHeader names the request header carrying the origin when a proxy in front moves it, e.g. "X-Forwarded-Origin".
+	// It is preferred over Origin, which is still used when the request lacks it. Defaults to Origin.
+	OriginHeader string `yaml:"origin_header"`
+
+	// DenialLogLimit is how many denials are logged per reason each minute before the rest are only counted.
+	// Defaults to 10 and a negative value logs every denial.
+	DenialLogLimit int `yaml:"denial_log_limit"`
+
+	// DenialRateLimit is how many requests from a client are denied each minute before its other denied requests
+	// that minute are refused with a 429 instead. Requests the policy allows are never refused. It is off by default.
+	DenialRateLimit int `yaml:"denial_rate_limit"`
+
+	// ClientHeader names a header holding the client address, e.g. X-Real-IP or X-Forwarded-For, set by a proxy in
+	// front of vulcand. DenialRateLimit then tells clients apart by it instead of by the connection's address.
+	// Only set it when every request passes through that proxy, since clients can send the header themselves.
+	ClientHeader string `yaml:"client_header"`
+
+	// OmitRetryAfter leaves out the Retry-After header, which otherwise tells refused clients when to try again.
+	OmitRetryAfter bool `yaml:"omit_retry_after"`
+
+	// DecisionCacheSize is how many recent denials are remembered, by origin, method and requested headers, so that
+	// identical requests are denied again without evaluating the policy. It is off by default.
+	DecisionCacheSize int `yaml:"decision_cache_size"`
+
+	// DenyStatus is the status code of denied requests, e.g. 400, or 200 for clients that take a 403 from the proxy
+	// for an authorization failure. The browser still blocks the response without CORS headers. Defaults to 403.
+	DenyStatus int `yaml:"deny_status"`
+
+	// DenyBody answers denied requests with a JSON body such as {"error":"cors_denied","reason":"bad_origin","origin":"..."},
+	// to ease debugging from the browser. Like ExposeDenialReason, it reveals part of the policy.
+	DenyBody bool `yaml:"deny_body"`
+
+	// DenyContentType is the Content-Type of the body written by DenyBody. Defaults to application/json.
+	DenyContentType string `yaml:"deny_content_type"`
+
+	// StealthDeny answers denied requests like a missing route, with StealthStatus and no CORS headers at all,
+	// instead of a 403. It takes precedence over ExposeDenialReason.
+	StealthDeny bool `yaml:"stealth_deny"`
+
+	// StealthStatus is the status code of stealthy denials. Defaults to 404.
+	StealthStatus int `yaml:"stealth_status"`
+
+	// ReportOnly lets denied requests through, answered as if allowed, and flags them with a ReportHeader such as
+	// "would-deny; reason=bad_origin" instead, so that a policy can be tried out on live traffic.
+	// Such requests are still logged and counted as denials. It takes precedence over StealthDeny.
+	ReportOnly bool `yaml:"report_only"`
+
+	// ReportHeader names the response header flagging denials when ReportOnly is set. Defaults to X-CORS-Report.
+	ReportHeader string `yaml:"report_header"`
+
+	// ExposeDenialReason tells clients why a request was denied in the X-CORS-Denied-Reason header.
+	// It reveals part of the policy, so it is meant for debugging.
+	ExposeDenialReason bool `yaml:"expose_denial_reason"`
+
+	// LiteralWildcard answers origins allowed by "*" with a literal "Access-Control-Allow-Origin: *" and no "Vary: Origin",
+	// so that public responses can be cached. By default the origin is reflected, as it always is when "*" allows credentials.
+	LiteralWildcard bool `yaml:"literal_wildcard"`
+
+	// StrictHead requires HEAD to be listed explicitly. By default origins allowed to use GET may also use HEAD.
+	StrictHead bool `yaml:"strict_head"`
+
+	// Debug logs every allowed request together with the rule that allowed it.
+	Debug bool `yaml:"debug"`
+
+	// JSONLogs logs each denial as a single JSON object, e.g. {"event":"cors_denied","reason":"bad_origin",...},
+	// instead of several lines of text.
+	JSONLogs bool `yaml:"json_logs"`
+
+	// LogFile is where logs go when Logger is not set: "stderr" (the default), "stdout" or the path of a file
+	// that is appended to, so that operators can separate CORS logs from those of vulcand.
+	LogFile string `yaml:"log_file"`
+
+	// ConfigFile is the file the configuration is reloaded from when Watch or ReloadOnHUP is set, without
+	// re-registering the middleware. An invalid file is logged and the previous configuration kept.
+	// These are set by the -corsFile, -watch and -reloadOnHUP flags rather than in the file.
+	ConfigFile string `yaml:"-"`
+
+	// Watch reloads ConfigFile whenever it changes.
+	Watch bool `yaml:"-"`
+
+	// ReloadOnHUP reloads ConfigFile whenever the process receives SIGHUP.
+	ReloadOnHUP bool `yaml:"-"`
+
+	// ConsulKey names a Consul KV key holding the configuration instead of ConfigFile.
+	// The key is watched and the configuration reloaded whenever it changes.
+	ConsulKey string `yaml:"-"`
+
+	// ConsulAddress is the HTTP address of the Consul agent holding ConsulKey. Defaults to http://127.0.0.1:8500.
+	ConsulAddress string `yaml:"-"`
+
+	// ConsulToken is the ACL token used to read ConsulKey, if any. Like other secrets it is left out of the
+	// serialized middleware, so vulcand falls back to its own CONSUL_HTTP_TOKEN environment variable.
+	ConsulToken string `json:"-" yaml:"-"`
+
+	// Overrides are the settings given as flags on top of ConfigFile or ConsulKey, applied again on each reload.
+	Overrides *Overrides `yaml:"-"`
+
+	// Logger receives denial and debug logs. Defaults to the standard logger when nil.
+	Logger *log.Logger `json:"-" yaml:"-"`
+
+	// OnDenied is called with every denied request, logged or not.
+	OnDenied func(r *http.Request, d Denial) `json:"-" yaml:"-"`
+
+	// Metrics receives observations about the requests handled. Nothing is recorded when it is nil.
+	Metrics Metrics `json:"-" yaml:"-"`
+
+	fileLogger *log.Logger            // writes to LogFile, nil when it is not set
+	exposed    map[string]string      // Access-Control-Expose-Headers values by rule, the default under ""
+	folded     map[string]string      // exact keys by lowercase origin, when ignoring case
+	hosts      map[string]string      // host-only keys by lowercase host
+	ports      map[string]string      // keys with a wildcard port by lowercase scheme and host
+	patterns   []pattern              // regular expression entries in key order
+	subdomains []subdomain            // entries matching every subdomain of a domain, in key order
+	suffixes   []string               // lowercase OriginSuffixes followed by those of SuffixFile
+	dynamic    *dynamicOrigins        // origins read from EtcdPrefix, set by NewHandler
+	policies   map[string]*Middleware // compiled Policies by name
+	routes     []string               // PolicyRoutes keys, longest first
 }
 
 // NewHandler initializes a new handler from the middleware config and adds it to the middleware chain.
+// A config that was not built by New, FromOther or ParseConfig is validated first, so an empty one fails here
+// instead of denying every request.
 func (m *Middleware) NewHandler(next http.Handler) (http.Handler, error) {
-	return &Handler{next: next, cfg: *m}, nil
+	if m == nil {
+		return nil, errors.New(errorConfigOrigin)
+	}
+
+	if m.hosts == nil {
+		cfg, err := newMiddleware(*m)
+		if err != nil {
+			return nil, err
+		}
+
+		m = cfg
+	}
+
+	m.logger().Println(m.Summary())
+
+	if m.EtcdPrefix != "" && m.dynamic == nil {
+		cfg := *m
+		cfg.dynamic = &dynamicOrigins{}
+		m = &cfg
+	}
+
+	h := &Handler{next: next}
+	h.denials.config = h.config
+	h.SetConfig(m)
+
+	if m.dynamic != nil {
+		h.watchEtcd(m)
+	}
+
+	if m.ConsulKey != "" {
+		h.watchConsul(m)
+	}
+
+	if m.ConfigFile != "" && (m.Watch || m.ReloadOnHUP) {
+		if err := h.reloadOn(m); err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+// Wrap validates the configuration and applies it to a plain net/http handler, for use without Vulcand.
+// Like NewHandler it reports invalid configurations and background work that cannot start, such as watching
+// the configuration. Close the returned handler once it is no longer used to stop that work.
+func Wrap(cfg Middleware, next http.Handler) (*Handler, error) {
+	m, err := newMiddleware(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := m.NewHandler(next)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.(*Handler), nil
 }
 
 // String() will be called by loggers inside Vulcand and command line tool.
 func (m *Middleware) String() string {
-	return fmt.Sprintf("origins=%v", m.AllowedOrigins)
+	origins := make([]string, 0, len(m.AllowedOrigins))
+	for origin := range m.AllowedOrigins {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+
+	rules := make([]string, len(origins))
+	for i, origin := range origins {
+		rules[i] = fmt.Sprintf("%s{%v}", origin, m.AllowedOrigins[origin])
+	}
+
+	return fmt.Sprintf("origins=[%s], defaultPolicy={%v}, allowPrivateNetwork=%t", strings.Join(rules, ", "), m.DefaultPolicy, m.AllowPrivateNetwork)
 }
 
-// Validates that the given origin is allowed.
-func (m *Middleware) isOriginAllowed(origin string) bool {
-	if origin == "" {
-		return false
-	} else if m.AllowedOrigins[allToken] != nil {
-		return true
-	} else if m.AllowedOrigins[origin] != nil {
-		return true
-	} else if m.originMatchesRegex(origin) {
-		return true
+// Summary describes the effective policy on a single line, to confirm which configuration was loaded.
+func (m *Middleware) Summary() string {
+	var min, max int64
+	hosts := make([]*host, 0, len(m.AllowedOrigins)+1)
+	for _, cfg := range m.AllowedOrigins {
+		hosts = append(hosts, cfg)
+	}
+	if m.DefaultPolicy != nil {
+		hosts = append(hosts, m.DefaultPolicy)
+	}
+	if m.EtcdPolicy != nil {
+		hosts = append(hosts, m.EtcdPolicy)
+	}
+	if m.AllowNullOrigin != nil {
+		hosts = append(hosts, m.AllowNullOrigin)
 	}
 
-	return false
+	credentials := false
+	for i, cfg := range hosts {
+		credentials = credentials || cfg.Credentials
+		age := m.maxAge(cfg)
+		if i == 0 || age < min {
+			min = age
+		}
+		if i == 0 || age > max {
+			max = age
+		}
+	}
+
+	maxAge := strconv.FormatInt(min, 10)
+	if max != min {
+		maxAge = fmt.Sprintf("%d-%d", min, max)
+	}
+
+	_, wildcard := m.AllowedOrigins[allToken]
+	return fmt.Sprintf("CORS policy loaded: origins=%d wildcard=%t defaultPolicy=%t credentials=%t maxAge=%s", len(m.AllowedOrigins), wildcard, m.DefaultPolicy != nil, credentials, maxAge)
+}
+
+// Summarizes a single origin configuration.
+func (h *host) String() string {
+	if h == nil {
+		return ""
+	}
+
+	s := fmt.Sprintf("methods=%s headers=%s maxAge=%d enabled=%t", strings.Join(h.Methods, ","), strings.Join(h.Headers, ","), h.MaxAge, h.enabled())
+	if h.Credentials {
+		s += " credentials=true"
+	}
+	if h.AllowPrivateNetwork {
+		s += " allowPrivateNetwork=true"
+	}
+	if h.TimingAllowOrigin {
+		s += " timingAllowOrigin=true"
+	}
+	if h.ExposedHeaders != nil {
+		s += " exposedHeaders=" + strings.Join(h.ExposedHeaders, ",")
+	}
+
+	return s
+}
+
+// Reports whether the origin is enabled.
+func (h *host) enabled() bool {
+	return h.Enabled == nil || *h.Enabled
 }
 
-func (m *Middleware) originMatchesRegex(origin string) bool {
-	re, err := regexp.Compile("^/(.+)/$")
+// Reports whether the scheme of the given origin is acceptable for this configuration.
+func (h *host) schemeAllowed(origin string) bool {
+	if len(h.Schemes) == 0 {
+		return true
+	}
+
+	u, err := url.Parse(origin)
 	if err != nil {
 		return false
 	}
 
+	return stringInSlice(strings.ToLower(u.Scheme), h.Schemes)
+}
+
+// Returns a shallow copy of the origin configuration.
+func (h *host) copy() *host {
+	if h == nil {
+		return nil
+	}
+
+	c := *h
+	return &c
+}
+
+// Returns the ACL token used to read ConsulKey, read from the environment when it was not set.
+func (m *Middleware) consulToken() string {
+	if m.ConsulToken == "" {
+		return os.Getenv(consulTokenEnv)
+	}
+
+	return m.ConsulToken
+}
+
+// Returns the configured logger or the standard logger.
+func (m *Middleware) logger() *log.Logger {
+	if m.Logger != nil {
+		return m.Logger
+	}
+
+	if m.fileLogger != nil {
+		return m.fileLogger
+	}
+
+	return log.Default()
+}
+
+func (m *Middleware) consulAddress() string {
+	if m.ConsulAddress == "" {
+		return defaultConsulAddress
+	}
+
+	if !isConfigURL(m.ConsulAddress) {
+		return "http://" + m.ConsulAddress
+	}
+
+	return m.ConsulAddress
+}
+
+// Precomputes the host-only and regular expression entries and the response headers so that requests never modify the configuration.
+func (m *Middleware) compile() error {
+	keys := make([]string, 0, len(m.AllowedOrigins))
 	for k := range m.AllowedOrigins {
-		if re.MatchString(k) {
-			url := fmt.Sprintf("^%s$", re.FindStringSubmatch(k)[1])
-			match, _ := regexp.MatchString(url, origin)
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 
-			if match {
-				m.AllowedOrigins[origin] = m.AllowedOrigins[k]
-				return true
+	flags := ""
+	if m.IgnoreOriginCase {
+		flags = "(?i)"
+	}
+
+	m.folded = map[string]string{}
+	m.hosts = map[string]string{}
+	m.ports = map[string]string{}
+	m.patterns = nil
+	m.subdomains = nil
+	for _, k := range keys {
+		if m.IgnoreOriginCase {
+			m.folded[strings.ToLower(k)] = k
+		}
+
+		if sub := regexKey.FindStringSubmatch(k); sub != nil {
+			re, err := regexp.Compile(fmt.Sprintf("%s^%s$", flags, sub[1]))
+			if err != nil {
+				return fmt.Errorf("%s %s: %v", errorConfigPattern, k, err)
 			}
+
+			m.patterns = append(m.patterns, pattern{k, re})
+		} else if sub, ok := parseSubdomainKey(k); ok {
+			m.subdomains = append(m.subdomains, sub)
+		} else if isHostOnly(k) {
+			m.hosts[strings.ToLower(k)] = k
+		} else if strings.HasSuffix(k, anyPort) {
+			m.ports[schemeAndHost(strings.TrimSuffix(k, anyPort))] = k
 		}
+
+		m.prepare(m.AllowedOrigins[k])
 	}
 
-	return false
+	if m.DefaultPolicy != nil {
+		m.prepare(m.DefaultPolicy)
+	}
+
+	if m.SuffixPolicy != nil {
+		m.prepare(m.SuffixPolicy)
+	}
+
+	if m.EtcdPolicy != nil {
+		m.prepare(m.EtcdPolicy)
+	}
+
+	if m.AllowNullOrigin != nil {
+		m.prepare(m.AllowNullOrigin)
+	}
+
+	m.exposed = map[string]string{"": joinHeaders(m.DefaultExposedHeaders)}
+	for rule, headers := range m.ExposedHeaders {
+		m.exposed[rule] = joinHeaders(headers)
+	}
+
+	return m.compilePolicies()
+}
+
+// Compiles each policy into a copy of the configuration serving its origins.
+func (m *Middleware) compilePolicies() error {
+	m.policies = nil
+	m.routes = nil
+	if len(m.Policies) == 0 {
+		return nil
+	}
+
+	m.policies = make(map[string]*Middleware, len(m.Policies))
+	for name, origins := range m.Policies {
+		p := *m
+		p.AllowedOrigins = origins
+		p.DefaultPolicy = nil
+		p.SuffixPolicy = nil
+		p.suffixes = nil
+		p.EtcdPrefix = ""
+		p.EtcdPolicy = nil
+		p.Policies = nil
+		p.PolicyRoutes = nil
+		if err := p.compile(); err != nil {
+			return fmt.Errorf("%s%s: %v", policiesPrefix, name, err)
+		}
+
+		m.policies[name] = &p
+	}
+
+	for route := range m.PolicyRoutes {
+		m.routes = append(m.routes, route)
+	}
+
+	sort.Slice(m.routes, func(i, j int) bool {
+		if len(m.routes[i]) != len(m.routes[j]) {
+			return len(m.routes[i]) > len(m.routes[j])
+		}
+
+		return m.routes[i] < m.routes[j]
+	})
+
+	return nil
+}
+
+// Returns the configuration of the policy routed to for the request, or the configuration itself when no route matches.
+func (m *Middleware) policyFor(r *http.Request) *Middleware {
+	for _, route := range m.routes {
+		i := strings.Index(route, "/")
+		if i == 0 || strings.EqualFold(route[:i], r.Host) {
+			if strings.HasPrefix(r.URL.Path, route[i:]) {
+				return m.policies[m.PolicyRoutes[route]]
+			}
+		}
+	}
+
+	return m
+}
+
+// Precomputes the response header values of an origin so that requests do not rebuild them.
+func (m *Middleware) prepare(h *host) {
+	h.methods = m.originMethods(h)
+	h.allowMethods = strings.Join(h.methods, ", ")
+	h.maxAge = strconv.FormatInt(m.maxAge(h), 10)
+	h.exposed = joinHeaders(h.ExposedHeaders)
+}
+
+// Reports whether a rule matches more than one exact scheme, host and port: "*", a pattern, a wildcard subdomain
+// or port, a host-only key, an origin suffix, or the default and etcd policies. Such rules never grant credentials.
+func broadRule(rule string) bool {
+	if rule == nullOriginRule || rule == nullOrigin {
+		return false
+	}
+
+	return !strings.Contains(rule, "://") || strings.Contains(rule, allToken) || regexKey.MatchString(rule)
+}
+
+// Reports whether an allowed origin key names only a host.
+func isHostOnly(key string) bool {
+	return key != allToken && !strings.Contains(key, "://") && !regexKey.MatchString(key)
+}
+
+// Returns the lowercase scheme of an origin key, or an empty string for "*", host-only and regular expression keys.
+func keyScheme(key string) string {
+	i := strings.Index(key, "://")
+	if i < 0 || regexKey.MatchString(key) {
+		return ""
+	}
+
+	return strings.ToLower(key[:i])
+}
+
+// Looks for the configuration that applies to the given origin and the rule that selected it.
+// The exact origin wins, then wildcard port, host-only, subdomain and regular expression entries, then origin suffixes,
+// origins read from etcd, "*" and finally the default policy. The "null" origin only matches AllowNullOrigin or a "null" entry.
+func (m *Middleware) findOrigin(origin string) (*host, string) {
+	if origin == "" {
+		return nil, ""
+	}
+
+	if origin == nullOrigin {
+		if m.AllowNullOrigin != nil {
+			return m.AllowNullOrigin, nullOriginRule
+		}
+		if allowedOrigin := m.AllowedOrigins[origin]; allowedOrigin != nil {
+			return allowedOrigin, origin
+		}
+		return nil, ""
+	}
+
+	if allowedOrigin := m.AllowedOrigins[origin]; allowedOrigin != nil {
+		return allowedOrigin, origin
+	}
+
+	if rule := m.folded[strings.ToLower(origin)]; rule != "" {
+		return m.AllowedOrigins[rule], rule
+	}
+
+	if rule := m.findPort(origin); rule != "" {
+		return m.AllowedOrigins[rule], rule
+	}
+
+	if rule := m.findHost(origin); rule != "" {
+		return m.AllowedOrigins[rule], rule
+	}
+
+	if rule := m.findSubdomain(origin); rule != "" {
+		return m.AllowedOrigins[rule], rule
+	}
+
+	if rule := m.findPattern(origin); rule != "" {
+		return m.AllowedOrigins[rule], rule
+	}
+
+	if rule := m.findSuffix(origin); rule != "" {
+		return m.SuffixPolicy, rule
+	}
+
+	if m.EtcdPolicy != nil && m.dynamic.has(origin) {
+		return m.EtcdPolicy, etcdPolicyRule
+	}
+
+	if allowedOrigin := m.AllowedOrigins[allToken]; allowedOrigin != nil {
+		return allowedOrigin, allToken
+	}
+
+	if m.DefaultPolicy != nil {
+		return m.DefaultPolicy, defaultPolicyRule
+	}
+
+	return nil, ""
+}
+
+// Looks for a host-only entry (one without a scheme) matching the host of the given origin on any scheme or port.
+func (m *Middleware) findHost(origin string) string {
+	if len(m.hosts) == 0 {
+		return ""
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	return m.hosts[strings.ToLower(u.Hostname())]
+}
+
+// Looks for an entry with a wildcard port, such as "https://example.com:*", matching the scheme and host of the given origin.
+func (m *Middleware) findPort(origin string) string {
+	if len(m.ports) == 0 {
+		return ""
+	}
+
+	return m.ports[schemeAndHost(origin)]
+}
+
+// Looks for a subdomain entry, such as "https://*.example.com", matching the scheme, host and port of the given origin.
+func (m *Middleware) findSubdomain(origin string) string {
+	if len(m.subdomains) == 0 {
+		return ""
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	scheme, hostname := strings.ToLower(u.Scheme), strings.ToLower(u.Hostname())
+	for _, s := range m.subdomains {
+		if s.scheme != "" && s.scheme != scheme || s.port != allToken && s.port != u.Port() {
+			continue
+		}
+
+		// The suffix starts with a dot, so the domain itself and "evilexample.com" never match ".example.com".
+		if len(hostname) > len(s.suffix) && strings.HasSuffix(hostname, s.suffix) {
+			return s.key
+		}
+	}
+
+	return ""
+}
+
+// Looks for an origin suffix matching the host of the given origin on a label boundary.
+func (m *Middleware) findSuffix(origin string) string {
+	if len(m.suffixes) == 0 {
+		return ""
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	hostname := strings.ToLower(u.Hostname())
+	for _, suffix := range m.suffixes {
+		// Suffixes start with a dot, so "evilexample.com" never matches ".example.com".
+		if strings.HasSuffix(hostname, suffix) {
+			return suffix
+		}
+	}
+
+	return ""
+}
+
+// Returns the lowercase scheme and host of an origin without its port, or an empty string when it has none.
+func schemeAndHost(origin string) string {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+
+	return strings.ToLower(u.Scheme + "://" + u.Hostname())
+}
+
+// Looks for a regular expression entry matching the given origin.
+func (m *Middleware) findPattern(origin string) string {
+	for _, p := range m.patterns {
+		if p.re.MatchString(origin) {
+			return p.key
+		}
+	}
+
+	return ""
+}
+
+// Returns the origin of the request, read from the configured header when present.
+func (m *Middleware) requestOrigin(r *http.Request) string {
+	if m.OriginHeader != "" {
+		if origin := r.Header.Get(m.OriginHeader); origin != "" {
+			return origin
+		}
+	}
+
+	return r.Header.Get(originHeader)
+}
+
+// Returns how many denials are logged per reason and interval.
+func (m *Middleware) denialLogLimit() int {
+	if m.DenialLogLimit == 0 {
+		return denialLogLimit
+	}
+
+	return m.DenialLogLimit
+}
+
+// Returns the Access-Control-Expose-Headers value for the rule an origin matched, which may be empty.
+func (m *Middleware) exposedHeaders(rule string) string {
+	for _, key := range []string{rule, allToken} {
+		if headers, ok := m.ExposedHeaders[key]; ok {
+			if m.exposed != nil {
+				return m.exposed[key]
+			}
+
+			return joinHeaders(headers)
+		}
+	}
+
+	if m.exposed != nil {
+		return m.exposed[""]
+	}
+
+	return joinHeaders(m.DefaultExposedHeaders)
+}
+
+// Returns the Access-Control-Expose-Headers value for an allowed origin: its own exposed headers when it lists any,
+// otherwise those of the rule it matched.
+func (m *Middleware) originExposedHeaders(h *host, rule string) string {
+	if h.ExposedHeaders != nil {
+		return h.exposed
+	}
+
+	return m.exposedHeaders(rule)
+}
+
+// Returns the status code of successful preflight responses.
+func (m *Middleware) preflightStatus() int {
+	if m.PreflightStatus == 0 {
+		return http.StatusOK
+	}
+
+	return m.PreflightStatus
+}
+
+// Returns the address of the client sending the request, as told by ClientHeader or else by the connection.
+func (m *Middleware) clientAddress(r *http.Request) string {
+	if m.ClientHeader != "" {
+		// Proxies append to X-Forwarded-For, so the last address is the one the trusted proxy saw.
+		if values := r.Header.Values(m.ClientHeader); len(values) > 0 {
+			addresses := strings.Split(values[len(values)-1], ",")
+			if address := strings.TrimSpace(addresses[len(addresses)-1]); address != "" {
+				return address
+			}
+		}
+	}
+
+	if address, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return address
+	}
+
+	return r.RemoteAddr
+}
+
+// Returns the headers allowed to every origin, the CORS-safelisted ones by default.
+func (m *Middleware) simpleHeaders() []string {
+	if m.SimpleHeaders == nil {
+		return defaultSimpleHeaders
+	}
+
+	return m.SimpleHeaders
+}
+
+// Returns the status code of stealthy denials.
+func (m *Middleware) stealthStatus() int {
+	if m.StealthStatus == 0 {
+		return http.StatusNotFound
+	}
+
+	return m.StealthStatus
+}
+
+// Reports whether CORS applies to the request according to ApplyHeader and ApplyValue.
+func (m *Middleware) applies(r *http.Request) bool {
+	if m.ApplyHeader == "" {
+		return true
+	}
+
+	values, ok := r.Header[http.CanonicalHeaderKey(m.ApplyHeader)]
+	if !ok {
+		return false
+	}
+
+	return m.ApplyValue == "" || stringInSlice(m.ApplyValue, values)
+}
+
+// Returns the status code of denied requests.
+func (m *Middleware) denyStatus() int {
+	if m.DenyStatus == 0 {
+		return http.StatusForbidden
+	}
+
+	return m.DenyStatus
+}
+
+// Returns the content type of denial bodies.
+func (m *Middleware) denyContentType() string {
+	if m.DenyContentType == "" {
+		return jsonContentType
+	}
+
+	return m.DenyContentType
+}
+
+// Returns the name of the header flagging denials when only reporting them.
+func (m *Middleware) reportHeader() string {
+	if m.ReportHeader == "" {
+		return reportHeader
+	}
+
+	return m.ReportHeader
 }
 
 // Return max age value
-func (m *Middleware) maxAgeForOrigin(origin string) int64 {
+func (m *Middleware) maxAge(allowedOrigin *host) int64 {
+	if allowedOrigin.MaxAge != 0 {
+		return allowedOrigin.MaxAge
+	}
+
+	if m.DefaultMaxAge != 0 {
+		return m.DefaultMaxAge
+	}
+
+	return defaultMaxAge
+}
 
-	hostCfg := m.AllowedOrigins[origin]
-	if hostCfg == nil || hostCfg.MaxAge == 0 {
-		return 86400
+// Reports whether the request is a preflight to be answered by the middleware.
+func (m *Middleware) isPreflight(r *http.Request) bool {
+	if r.Method != optionsMethod {
+		return false
 	}
-	return hostCfg.MaxAge
+
+	return !m.PassPlainOptions || r.Header.Get(requestMethodHeader) != ""
 }
 
 // Validates that the given method is allowed.
-func (m *Middleware) isMethodAllowed(method string, origin string) bool {
+func (m *Middleware) isMethodAllowed(method string, allowedOrigin *host) bool {
 	if method == "" {
 		return false
 	}
@@ -85,13 +1086,53 @@ func (m *Middleware) isMethodAllowed(method string, origin string) bool {
 		return true
 	}
 
-	allowedOrigin := m.findOrigin(origin)
-	if allowedOrigin == nil {
+	if len(m.GlobalMethods) > 0 && !m.inMethods(method, m.GlobalMethods) {
 		return false
 	}
 
-	for _, m := range allowedOrigin.Methods {
-		if m == allToken || m == method {
+	return m.inMethods(method, allowedOrigin.Methods)
+}
+
+// Returns the Access-Control-Allow-Methods value of a preflight: the methods the origin may use,
+// always including the allowed method that was requested.
+func (m *Middleware) allowedMethods(requested string, allowedOrigin *host) string {
+	if allowedOrigin.allowMethods != "" && stringInSlice(requested, allowedOrigin.methods) {
+		return allowedOrigin.allowMethods
+	}
+
+	methods := m.originMethods(allowedOrigin)
+	if !stringInSlice(requested, methods) {
+		methods = append(methods, requested)
+	}
+
+	return strings.Join(methods, ", ")
+}
+
+// Lists the methods the origin may use. The list is empty when the origin allows any method and there are no global methods.
+func (m *Middleware) originMethods(allowedOrigin *host) []string {
+	var methods []string
+	if stringInSlice(allToken, allowedOrigin.Methods) {
+		methods = append(methods, m.GlobalMethods...)
+	} else {
+		for _, method := range allowedOrigin.Methods {
+			if len(m.GlobalMethods) == 0 || m.inMethods(method, m.GlobalMethods) {
+				methods = append(methods, method)
+			}
+		}
+	}
+
+	return methods
+}
+
+// Reports whether a list of methods includes the given method.
+func (m *Middleware) inMethods(method string, methods []string) bool {
+	for _, allowed := range methods {
+		if allowed == allToken || allowed == method {
+			return true
+		}
+
+		// HEAD is fetched like GET, so it is allowed along with it unless it must be listed.
+		if !m.StrictHead && method == headMethod && allowed == getMethod {
 			return true
 		}
 	}
@@ -99,37 +1140,136 @@ func (m *Middleware) isMethodAllowed(method string, origin string) bool {
 	return false
 }
 
-// Validates that ALL of the given headers are allowed.
-func (m *Middleware) areHeadersAllowed(headers []string, origin string) bool {
-	if len(headers) == 0 {
-		return true
+// Logs the settings that load but are likely mistakes, see Warnings.
+func (m *Middleware) warn() {
+	for _, warning := range m.Warnings() {
+		m.logger().Printf("CORS warning: %s\n", warning)
 	}
+}
 
-	allowedOrigin := m.findOrigin(origin)
-	if allowedOrigin == nil {
-		return false
+// Warnings lists the settings that load but are likely mistakes: methods outside of the global methods,
+// which are never allowed, and credentials granted to the "null" origin, which any sandboxed page can send.
+func (m *Middleware) Warnings() []string {
+	var warnings []string
+
+	origins := make([]string, 0, len(m.AllowedOrigins))
+	for origin := range m.AllowedOrigins {
+		origins = append(origins, origin)
 	}
+	sort.Strings(origins)
 
-	if stringInSlice(allToken, allowedOrigin.Headers) {
-		return true
+	for _, origin := range origins {
+		cfg := m.AllowedOrigins[origin]
+		if len(m.GlobalMethods) > 0 {
+			for _, method := range cfg.Methods {
+				if method != allToken && !m.inMethods(method, m.GlobalMethods) {
+					warnings = append(warnings, fmt.Sprintf("%v allows %v, which is not in global_methods and will be denied", origin, method))
+				}
+			}
+		}
+	}
+
+	if m.AllowNullOrigin != nil && m.AllowNullOrigin.Credentials {
+		warnings = append(warnings, fmt.Sprintf("%v grants credentials to every sandboxed page", nullOriginRule))
+	}
+
+	names := make([]string, 0, len(m.policies))
+	for name := range m.policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, warning := range m.policies[name].Warnings() {
+			warnings = append(warnings, policiesPrefix+name+" "+warning)
+		}
+	}
+
+	return warnings
+}
+
+// Methods origins may list unless KnownMethods replaces them.
+var defaultKnownMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// Reports whether the given uppercase method may be listed by origins.
+func (m *Middleware) isKnownMethod(method string) bool {
+	known := m.KnownMethods
+	if known == nil {
+		known = defaultKnownMethods
+	}
+
+	for _, k := range known {
+		if strings.ToUpper(strings.TrimSpace(k)) == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Names of headers scripts may not set according to https://fetch.spec.whatwg.org/#forbidden-request-header.
+// Names ending in "-" are prefixes.
+var defaultForbiddenHeaders = []string{
+	"Accept-Charset", "Accept-Encoding", "Access-Control-Request-Headers", "Access-Control-Request-Method",
+	"Connection", "Content-Length", "Cookie", "Cookie2", "Date", "Dnt", "Expect", "Host", "Keep-Alive",
+	"Origin", "Referer", "Set-Cookie", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Via",
+	"Proxy-", "Sec-",
+}
+
+// Reports whether any of the given headers is forbidden.
+func (m *Middleware) hasForbiddenHeader(headers []string) bool {
+	forbidden := m.ForbiddenHeaders
+	if forbidden == nil {
+		forbidden = defaultForbiddenHeaders
 	}
 
 	for _, h := range headers {
 		h = http.CanonicalHeaderKey(h)
-		if h != "" && !stringInSlice(h, allowedOrigin.Headers) {
-			return false
+		for _, f := range forbidden {
+			f = http.CanonicalHeaderKey(f)
+			if h == f || strings.HasSuffix(f, "-") && strings.HasPrefix(h, f) {
+				return true
+			}
 		}
 	}
 
-	return true
+	return false
+}
+
+// Names of the CORS-safelisted request headers according to https://fetch.spec.whatwg.org/#cors-safelisted-request-header.
+// Content-Type is left out: browsers only request it in a preflight when its value is not one of the safelisted
+// form and text types, e.g. application/json, which origins must then allow by name.
+var defaultSimpleHeaders = []string{"Accept", "Accept-Language", "Content-Language"}
+
+// Reports whether the given canonical header name may be requested by any origin.
+func (m *Middleware) isSimpleHeader(header string) bool {
+	for _, s := range m.simpleHeaders() {
+		if http.CanonicalHeaderKey(s) == header {
+			return true
+		}
+	}
+
+	return false
 }
 
-// Looks for the given origin or "*" if present.
-func (m *Middleware) findOrigin(origin string) *host {
-	allowedOrigin := m.AllowedOrigins[origin]
-	if allowedOrigin == nil {
-		allowedOrigin = m.AllowedOrigins[allToken]
+// Validates that ALL of the given headers are allowed.
+func (m *Middleware) areHeadersAllowed(headers []string, allowedOrigin *host) bool {
+	if len(headers) == 0 {
+		return true
+	}
+
+	wildcard := stringInSlice(allToken, allowedOrigin.Headers)
+	for _, h := range headers {
+		h = http.CanonicalHeaderKey(h)
+		if h == "" || stringInSlice(h, allowedOrigin.Headers) || m.isSimpleHeader(h) {
+			continue
+		}
+
+		// Like browsers, "*" does not stand for Authorization, which has to be listed by name.
+		if !wildcard || h == authorizationHeader {
+			return false
+		}
 	}
 
-	return allowedOrigin
+	return true
 }
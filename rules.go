@@ -0,0 +1,106 @@
+package cors
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Rule is what the middleware enforces for one origin key or fallback, once defaults, method groups,
+// global methods and the safelisted headers are applied.
+type Rule struct {
+	Origin          string   // the origin key, origin suffix or fallback such as "default_policy", after "policies.<name> " for a policy
+	Methods         []string // the methods allowed, HEAD included when GET implies it
+	Headers         []string // the request headers allowed, the CORS-safelisted ones included
+	ExposedHeaders  string   // the Access-Control-Expose-Headers value of actual responses, empty when nothing is exposed
+	MaxAge          int64    // the Access-Control-Max-Age of preflight responses, in seconds
+	Credentials     bool     // whether responses allow credentials
+	PrivateNetwork  bool     // whether Private Network Access preflights are answered
+	Schemes         []string // the schemes accepted, any when empty
+	Enabled         bool     // whether the origin is allowed at all
+	SuppressHeaders bool     // whether allowed requests pass without Access-Control-* headers
+}
+
+// Rules lists the effective policy of a validated configuration: origin keys in order, then origin suffixes,
+// origins read from etcd, the "null" origin and the default policy, followed by the rules of each policy.
+func (m *Middleware) Rules() []Rule {
+	var rules []Rule
+
+	origins := make([]string, 0, len(m.AllowedOrigins))
+	for origin := range m.AllowedOrigins {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+
+	for _, origin := range origins {
+		rules = append(rules, m.rule(origin, origin, m.AllowedOrigins[origin]))
+	}
+
+	if m.SuffixPolicy != nil {
+		for _, suffix := range m.suffixes {
+			rules = append(rules, m.rule(suffix, suffixPolicyRule, m.SuffixPolicy))
+		}
+	}
+
+	if m.EtcdPolicy != nil {
+		rules = append(rules, m.rule(etcdPolicyRule+" "+m.EtcdPrefix, etcdPolicyRule, m.EtcdPolicy))
+	}
+
+	if m.AllowNullOrigin != nil {
+		rules = append(rules, m.rule(nullOriginRule, nullOriginRule, m.AllowNullOrigin))
+	}
+
+	if m.DefaultPolicy != nil {
+		rules = append(rules, m.rule(defaultPolicyRule, defaultPolicyRule, m.DefaultPolicy))
+	}
+
+	names := make([]string, 0, len(m.policies))
+	for name := range m.policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, rule := range m.policies[name].Rules() {
+			rule.Origin = policiesPrefix + name + " " + rule.Origin
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+// Resolves a single origin configuration, matched under the given rule, into what is enforced for it.
+func (m *Middleware) rule(origin, rule string, cfg *host) Rule {
+	methods := append([]string(nil), cfg.methods...)
+	if len(methods) == 0 && stringInSlice(allToken, cfg.Methods) {
+		methods = []string{allToken}
+	}
+	if !m.StrictHead && stringInSlice(getMethod, methods) && !stringInSlice(headMethod, methods) {
+		methods = append(methods, headMethod)
+	}
+
+	var headers []string
+	if stringInSlice(allToken, cfg.Headers) {
+		headers = []string{allToken}
+	} else {
+		for _, header := range append(append([]string(nil), cfg.Headers...), m.simpleHeaders()...) {
+			header = http.CanonicalHeaderKey(header)
+			if !stringInSlice(header, headers) {
+				headers = append(headers, header)
+			}
+		}
+	}
+
+	return Rule{
+		Origin:          origin,
+		Methods:         methods,
+		Headers:         headers,
+		ExposedHeaders:  m.originExposedHeaders(cfg, rule),
+		MaxAge:          m.maxAge(cfg),
+		Credentials:     cfg.Credentials,
+		PrivateNetwork:  m.AllowPrivateNetwork || cfg.AllowPrivateNetwork,
+		Schemes:         cfg.Schemes,
+		Enabled:         cfg.enabled(),
+		SuppressHeaders: cfg.SuppressHeaders,
+	}
+}
@@ -0,0 +1,162 @@
+package cors
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// denialThrottle limits how many denials are logged per reason within each interval, so a flood of
+// denied requests cannot drown out other logs. Denials over the limit are counted and summarized
+// when the interval is over, or when the handler is closed.
+type denialThrottle struct {
+	mu         sync.Mutex
+	start      time.Time
+	logged     map[string]int
+	suppressed map[string]int
+	timer      *time.Timer        // summarizes the current interval once it is over, nil when nothing was suppressed
+	config     func() *Middleware // the configuration in use when the timer fires, whose logger gets the summary
+}
+
+// Reports whether a denial for the given reason should be logged.
+func (t *denialThrottle) allow(cfg *Middleware, reason string) bool {
+	limit := cfg.denialLogLimit()
+	if limit < 0 {
+		return true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.logged == nil || now.Sub(t.start) >= denialLogInterval {
+		t.flush(cfg)
+		t.start = now
+		t.logged = map[string]int{}
+		t.suppressed = map[string]int{}
+	}
+
+	if t.logged[reason] < limit {
+		t.logged[reason]++
+		return true
+	}
+
+	// Summarize without waiting for another denial, which may never come.
+	if t.timer == nil {
+		start := t.start
+		t.timer = time.AfterFunc(start.Add(denialLogInterval).Sub(now), func() {
+			// The configuration may have been replaced since, along with its logger.
+			current := t.config()
+
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			if t.start.Equal(start) {
+				t.flush(current)
+				t.logged = nil
+			}
+		})
+	}
+
+	t.suppressed[reason]++
+	return false
+}
+
+// Summarizes the denials suppressed so far and stops the timer. Called when the handler is closed.
+func (t *denialThrottle) close(cfg *Middleware) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.flush(cfg)
+	t.logged = nil
+}
+
+// Logs the denials suppressed during the current interval, if any, and forgets them. Must be called with mu held.
+func (t *denialThrottle) flush(cfg *Middleware) {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+
+	if len(t.suppressed) > 0 {
+		t.summarize(cfg)
+	}
+	t.suppressed = nil
+}
+
+// Logs how many denials were left out during the last interval.
+func (t *denialThrottle) summarize(cfg *Middleware) {
+	reasons := make([]string, 0, len(t.suppressed))
+	for reason := range t.suppressed {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	logger := cfg.logger()
+	for _, reason := range reasons {
+		if cfg.JSONLogs {
+			logJSON(logger, suppressedEvent{"cors_denials_not_logged", denialReasons[reason], t.suppressed[reason], t.start})
+			continue
+		}
+
+		logger.Printf("%s %s: %d more denials not logged since %v\n", errorRoot, reason, t.suppressed[reason], t.start.Format(time.RFC3339))
+	}
+}
+
+// suppressedEvent is a count of denials left out, as logged by JSONLogs.
+type suppressedEvent struct {
+	Event  string    `json:"event"`
+	Reason string    `json:"reason"`
+	Count  int       `json:"count"`
+	Since  time.Time `json:"since"`
+}
+
+// denialLimiter refuses clients whose requests were denied too often within the current interval,
+// so that a prober repeating denied requests is answered with a 429. Clients are told apart by address,
+// never by Origin, which any client can send. At most maxLimitedClients are tracked per interval.
+type denialLimiter struct {
+	mu     sync.Mutex
+	start  time.Time
+	denied map[string]int
+}
+
+// Records a policy denial for the given client.
+func (l *denialLimiter) record(cfg *Middleware, client string) {
+	if cfg.DenialRateLimit <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.reset(time.Now())
+	if _, ok := l.denied[client]; ok || len(l.denied) < maxLimitedClients {
+		l.denied[client]++
+	}
+}
+
+// Returns how long denied requests from the given client are still refused, or zero when they are not.
+func (l *denialLimiter) wait(cfg *Middleware, client string) time.Duration {
+	if cfg.DenialRateLimit <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.reset(now)
+	if l.denied[client] < cfg.DenialRateLimit {
+		return 0
+	}
+
+	return l.start.Add(denialRateInterval).Sub(now)
+}
+
+// Starts a new interval once the current one is over.
+func (l *denialLimiter) reset(now time.Time) {
+	if l.denied == nil || now.Sub(l.start) >= denialRateInterval {
+		l.start = now
+		l.denied = map[string]int{}
+	}
+}
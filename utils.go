@@ -1,5 +1,11 @@
 package cors
 
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
 // Searches for a string in a given slice.
 func stringInSlice(target string, list []string) bool {
 	for _, value := range list {
@@ -10,3 +16,90 @@ func stringInSlice(target string, list []string) bool {
 
 	return false
 }
+
+// Splits a comma separated header value, trimming whitespace and dropping empty entries.
+func parseHeaderList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+// Reports whether an Origin header value is safe to match and reflect:
+// it must not contain spaces or control characters and must parse as a URL.
+func isValidOrigin(origin string) bool {
+	for _, c := range origin {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+
+	if origin == nullOrigin {
+		return true
+	}
+
+	// Origins without a scheme or host, such as "example.com" or "//example.com", are never sent by browsers.
+	u, err := url.Parse(origin)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+// Returns the requested headers as a single list, joining them when they were sent on several lines.
+func requestedHeaders(r *http.Request) string {
+	return strings.Join(r.Header.Values(requestHeadersHeader), ",")
+}
+
+// Parses the requested headers like the fetch standard: the names from every Access-Control-Request-Headers line,
+// trimmed, without empty ones or ones repeated in any case. Names keep the case they were sent in, since they are
+// echoed back, and are compared regardless of case. Returns false when a name is not a valid header name.
+func parseRequestedHeaders(r *http.Request) ([]string, bool) {
+	var headers []string
+	seen := map[string]bool{}
+	for _, h := range parseHeaderList(requestedHeaders(r)) {
+		if !isToken(h) {
+			return nil, false
+		}
+
+		if key := strings.ToLower(h); !seen[key] {
+			seen[key] = true
+			headers = append(headers, h)
+		}
+	}
+
+	return headers, true
+}
+
+// Reports whether the string is a token as defined by RFC 7230, which header names must be.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Joins header names in their canonical form, dropping empty and repeated ones.
+func joinHeaders(headers []string) string {
+	var joined []string
+	for _, h := range headers {
+		h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+		if h != "" && !stringInSlice(h, joined) {
+			joined = append(joined, h)
+		}
+	}
+
+	return strings.Join(joined, ", ")
+}
@@ -0,0 +1,163 @@
+package cors
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Reloads the configuration file whenever it changes when m.Watch is set, and whenever the process
+// receives SIGHUP when m.ReloadOnHUP is set, until the handler is closed.
+func (h *Handler) reloadOn(m *Middleware) error {
+	path := m.ConfigFile
+
+	var changes <-chan fsnotify.Event
+	var watchErrs <-chan error
+	var watcher *fsnotify.Watcher
+	if m.Watch {
+		var err error
+		if watcher, err = watchDir(path); err != nil {
+			return err
+		}
+
+		changes, watchErrs = watcher.Events, watcher.Errors
+	}
+
+	var hup chan os.Signal
+	if m.ReloadOnHUP {
+		hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+	}
+
+	last, _ := loadConfigFile(path)
+	h.background(func(done <-chan struct{}) {
+		if watcher != nil {
+			defer watcher.Close()
+		}
+		if hup != nil {
+			defer signal.Stop(hup)
+		}
+
+		// Writes often come in bursts, so reload once they have settled.
+		settle := time.NewTimer(watchSettleDelay)
+		settle.Stop()
+		defer settle.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case _, ok := <-changes:
+				if !ok {
+					changes = nil
+					continue
+				}
+				settle.Reset(watchSettleDelay)
+			case err, ok := <-watchErrs:
+				if !ok {
+					watchErrs = nil
+					continue
+				}
+				h.config().logger().Printf("CORS watching %s failed: %v\n", path, err)
+			case <-settle.C:
+				last = h.reloadConfig(path, last)
+			case <-hup:
+				// An explicit request re-reads and re-validates the file even when it did not change.
+				last = h.reloadConfig(path, nil)
+			}
+		}
+	})
+
+	return nil
+}
+
+// Watches the directory of the configuration file rather than the file, so that editors and deployments
+// replacing the file by renaming another one over it are noticed as well.
+func watchDir(path string) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("%s: watching %s: %v", errorFileIO, path, err)
+	}
+
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("%s: watching %s: %v", errorFileIO, path, err)
+	}
+
+	return watcher, nil
+}
+
+// Loads the configuration file again and swaps it in when it differs from the data last read,
+// keeping the current configuration when the file is invalid. Returns the data read, so that
+// an invalid file is only reported once.
+func (h *Handler) reloadConfig(path string, last []byte) []byte {
+	data, err := loadConfigFile(path)
+	if err == nil && last != nil && bytes.Equal(data, last) {
+		return last
+	}
+
+	h.applyConfig(path, configFormat(path), data, err)
+	return data
+}
+
+// Swaps in the configuration read from source, or logs why it could not be read or is invalid and keeps the current one.
+func (h *Handler) applyConfig(source, format string, data []byte, err error) {
+	current := h.config()
+	logger := current.logger()
+
+	var cfg Middleware
+	if err == nil {
+		cfg, err = decodeConfig(data, format)
+	}
+
+	var m *Middleware
+	if err == nil {
+		// Settings made in code or on the command line rather than in the file carry over.
+		cfg.ConfigFile = current.ConfigFile
+		cfg.Watch = current.Watch
+		cfg.ReloadOnHUP = current.ReloadOnHUP
+		cfg.ConsulKey = current.ConsulKey
+		cfg.ConsulAddress = current.ConsulAddress
+		cfg.ConsulToken = current.ConsulToken
+		cfg.Logger = current.Logger
+		cfg.OnDenied = current.OnDenied
+		cfg.Metrics = current.Metrics
+		cfg.Overrides = current.Overrides
+		cfg.Overrides.apply(&cfg)
+		if cfg.EtcdPrefix != "" && !etcdChanged(current, &cfg) {
+			// The same prefix keeps being watched, so origins read from etcd carry over.
+			cfg.dynamic = current.dynamic
+		} else if cfg.EtcdPrefix != "" {
+			cfg.dynamic = &dynamicOrigins{}
+		}
+		m, err = newMiddleware(cfg)
+	}
+
+	if err != nil {
+		h.reloaded(err)
+		logger.Printf("CORS reload of %s failed, keeping the previous policy: %v\n", source, err)
+		return
+	}
+
+	h.SetConfig(m)
+	if etcdChanged(current, m) {
+		// The origins of the previous prefix or endpoints are dropped along with their watcher.
+		h.stopEtcd()
+		if m.dynamic != nil {
+			h.watchEtcd(m)
+		}
+	}
+	logger.Printf("CORS reloaded %s: %s\n", source, m.Summary())
+}
+
+// Reports whether the etcd keyspace read by the configurations differs. etcd_policy needs no new watcher.
+func etcdChanged(old, new *Middleware) bool {
+	return old.EtcdPrefix != new.EtcdPrefix || strings.Join(old.EtcdEndpoints, ",") != strings.Join(new.EtcdEndpoints, ",")
+}